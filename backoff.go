@@ -0,0 +1,43 @@
+package flyrpc
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponential delays with jitter between attempts.
+type Backoff struct {
+	// Min is the delay of the first attempt, default 100ms
+	Min time.Duration
+	// Max caps the delay, default 30s
+	Max time.Duration
+	// Factor multiplies the delay on each attempt, default 2
+	Factor float64
+	// Jitter randomly reduces the delay by up to this ratio, from 0 to 1
+	Jitter float64
+}
+
+// Duration returns the delay before attempt, counting from 0.
+func (b *Backoff) Duration(attempt int) time.Duration {
+	min, max, factor := b.Min, b.Max, b.Factor
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if factor < 1 {
+		factor = 2
+	}
+	d := float64(min)
+	for i := 0; i < attempt && d < float64(max); i++ {
+		d *= factor
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if b.Jitter > 0 {
+		d -= d * b.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
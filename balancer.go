@@ -0,0 +1,107 @@
+package flyrpc
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Balancer picks the connection of a ServiceClient for every call. conns
+// are the healthy connections, never empty.
+type Balancer interface {
+	Pick(conns []*ServiceConn) *ServiceConn
+}
+
+type roundRobinBalancer struct {
+	next int
+	lock sync.Mutex
+}
+
+// RoundRobinBalancer picks connections in turn.
+func RoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(conns []*ServiceConn) *ServiceConn {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.next++
+	return conns[b.next%len(conns)]
+}
+
+type weightedBalancer struct {
+	lock    sync.Mutex
+	current map[string]int
+}
+
+// WeightedBalancer picks connections in proportion to endpoint weights, with
+// the smooth weighted round-robin of nginx.
+func WeightedBalancer() Balancer {
+	return &weightedBalancer{current: make(map[string]int)}
+}
+
+func (b *weightedBalancer) Pick(conns []*ServiceConn) *ServiceConn {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var selected *ServiceConn
+	total := 0
+	for _, conn := range conns {
+		weight := conn.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		b.current[conn.Addr] += weight
+		if selected == nil || b.current[conn.Addr] > b.current[selected.Addr] {
+			selected = conn
+		}
+	}
+	b.current[selected.Addr] -= total
+	return selected
+}
+
+type leastPendingBalancer struct{}
+
+// LeastPendingBalancer picks the connection with the fewest outstanding calls.
+func LeastPendingBalancer() Balancer {
+	return leastPendingBalancer{}
+}
+
+func (leastPendingBalancer) Pick(conns []*ServiceConn) *ServiceConn {
+	selected := conns[0]
+	min := selected.NumPending()
+	for _, conn := range conns[1:] {
+		if n := conn.NumPending(); n < min {
+			selected = conn
+			min = n
+		}
+	}
+	return selected
+}
+
+type p2cBalancer struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// P2CBalancer picks two random connections and keeps the one with fewer
+// outstanding calls.
+func P2CBalancer() Balancer {
+	return &p2cBalancer{rand: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+func (b *p2cBalancer) Pick(conns []*ServiceConn) *ServiceConn {
+	if len(conns) == 1 {
+		return conns[0]
+	}
+	b.lock.Lock()
+	i := b.rand.Intn(len(conns))
+	j := b.rand.Intn(len(conns) - 1)
+	b.lock.Unlock()
+	if j >= i {
+		j++
+	}
+	if conns[j].NumPending() < conns[i].NumPending() {
+		return conns[j]
+	}
+	return conns[i]
+}
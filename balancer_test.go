@@ -0,0 +1,57 @@
+package flyrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeServiceConns(weights ...int) []*ServiceConn {
+	conns := make([]*ServiceConn, len(weights))
+	for i, w := range weights {
+		protocol := NewMockProtocol()
+		conns[i] = &ServiceConn{
+			Endpoint: Endpoint{Addr: string(rune('a' + i)), Weight: w},
+			Client:   &Client{Context: NewContext(protocol, NewRouter(JSON), 0, JSON)},
+		}
+	}
+	return conns
+}
+
+func countPicks(b Balancer, conns []*ServiceConn, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[b.Pick(conns).Addr]++
+	}
+	return counts
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	conns := makeServiceConns(0, 0, 0)
+	counts := countPicks(RoundRobinBalancer(), conns, 9)
+	assert.Equal(t, map[string]int{"a": 3, "b": 3, "c": 3}, counts)
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	conns := makeServiceConns(5, 1, 0)
+	counts := countPicks(WeightedBalancer(), conns, 70)
+	assert.Equal(t, map[string]int{"a": 50, "b": 10, "c": 10}, counts)
+}
+
+func TestLeastPendingBalancer(t *testing.T) {
+	conns := makeServiceConns(0, 0, 0)
+	conns[0].setCall(1, &pendingCall{})
+	conns[0].setCall(2, &pendingCall{})
+	conns[2].setCall(1, &pendingCall{})
+	assert.Equal(t, conns[1], LeastPendingBalancer().Pick(conns))
+}
+
+func TestP2CBalancer(t *testing.T) {
+	conns := makeServiceConns(0, 0)
+	conns[0].setCall(1, &pendingCall{})
+	b := P2CBalancer()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, conns[1], b.Pick(conns))
+	}
+	assert.Equal(t, conns[0], b.Pick(conns[:1]))
+}
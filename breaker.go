@@ -0,0 +1,116 @@
+package flyrpc
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerOpts configures a CircuitBreaker.
+type BreakerOpts struct {
+	// Threshold of consecutive failures opening the circuit, default 5
+	Threshold int
+	// OpenTimeout before a trial call is let through, default 10 seconds
+	OpenTimeout time.Duration
+	// FailureErrors are error codes counted as failures, default ErrTimeOut
+	// and ErrDisconnected. Other replies count as successes.
+	FailureErrors []string
+}
+
+// CircuitBreaker fails calls fast with ErrCircuitOpen while a target keeps
+// failing. Targets are Context.RemoteAddr, so connections of a Pool share
+// their state.
+type CircuitBreaker struct {
+	opts    *BreakerOpts
+	lock    sync.Mutex
+	targets map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	// trial is set while a half-open call is in flight
+	trial bool
+}
+
+func NewCircuitBreaker(opts *BreakerOpts) *CircuitBreaker {
+	if opts == nil {
+		opts = &BreakerOpts{}
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = 5
+	}
+	if opts.OpenTimeout == 0 {
+		opts.OpenTimeout = 10 * time.Second
+	}
+	if opts.FailureErrors == nil {
+		opts.FailureErrors = []string{ErrTimeOut, ErrDisconnected}
+	}
+	return &CircuitBreaker{
+		opts:    opts,
+		targets: make(map[string]*circuit),
+	}
+}
+
+// IsOpen reports whether calls to target fail fast.
+func (b *CircuitBreaker) IsOpen(target string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.targets[target]
+	return c != nil && c.failures >= b.opts.Threshold
+}
+
+// Interceptor returns the Interceptor to Use on contexts.
+func (b *CircuitBreaker) Interceptor() Interceptor {
+	return func(ctx *Context, code string, payload []byte, invoke Invoker) ([]byte, error) {
+		if !b.allow(ctx.RemoteAddr) {
+			return nil, newError(ErrCircuitOpen)
+		}
+		reply, err := invoke(ctx, code, payload)
+		b.done(ctx.RemoteAddr, err)
+		return reply, err
+	}
+}
+
+// allow lets a call through if the circuit is closed, or as the single
+// trial once OpenTimeout elapsed.
+func (b *CircuitBreaker) allow(target string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.targets[target]
+	if c == nil || c.failures < b.opts.Threshold {
+		return true
+	}
+	if c.trial || time.Since(c.openedAt) < b.opts.OpenTimeout {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+func (b *CircuitBreaker) done(target string, err error) {
+	failed := false
+	if err != nil {
+		for _, code := range b.opts.FailureErrors {
+			if err.Error() == code {
+				failed = true
+				break
+			}
+		}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.targets[target]
+	if !failed {
+		delete(b.targets, target)
+		return
+	}
+	if c == nil {
+		c = &circuit{}
+		b.targets[target] = c
+	}
+	c.failures++
+	c.trial = false
+	if c.failures >= b.opts.Threshold {
+		c.openedAt = time.Now()
+	}
+}
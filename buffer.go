@@ -0,0 +1,84 @@
+package flyrpc
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers of 512B to 1MB are pooled by power of 2 size, bigger ones are
+// left to the GC.
+const (
+	minBufferBits = 9
+	maxBufferBits = 20
+)
+
+var (
+	bufferPools [maxBufferBits - minBufferBits + 1]sync.Pool
+	packetPool  = sync.Pool{
+		New: func() interface{} {
+			return &Packet{}
+		},
+	}
+)
+
+// bufferClass returns the pool of buffers of at least n bytes, -1 if none.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferBits {
+		return 0
+	}
+	c := bits.Len(uint(n-1)) - minBufferBits
+	if c >= len(bufferPools) {
+		return -1
+	}
+	return c
+}
+
+// getBuffer returns a buffer of n bytes, its content is undefined.
+func getBuffer(n int) []byte {
+	c := bufferClass(n)
+	if c < 0 {
+		return make([]byte, n)
+	}
+	if v := bufferPools[c].Get(); v != nil {
+		return (*v.(*[]byte))[:n]
+	}
+	return make([]byte, n, 1<<(c+minBufferBits))
+}
+
+// putBuffer gives back a buffer of getBuffer, it must not be used after.
+func putBuffer(buf []byte) {
+	c := bufferClass(cap(buf))
+	if c < 0 || cap(buf) != 1<<(c+minBufferBits) {
+		return
+	}
+	buf = buf[:0]
+	bufferPools[c].Put(&buf)
+}
+
+func acquirePacket() *Packet {
+	return packetPool.Get().(*Packet)
+}
+
+// Release gives back a received packet and its payload to the pools, so
+// that the next packets reuse them. Neither may be used after, a packet is
+// released once at most.
+//
+// Packets of handlers are released when the handler returns, unless it
+// takes the payload as []byte, the *Packet or the *Context, see
+// WithReusedPayload. Context.Packet is never released.
+func (pkt *Packet) Release() {
+	if pkt.buf != nil {
+		putBuffer(pkt.buf)
+	}
+	*pkt = Packet{}
+	packetPool.Put(pkt)
+}
+
+// WithReusedPayload lends the []byte or *Packet param to the handler until
+// it returns, the buffer is reused by the next packets. The handler must copy
+// what it keeps, Context.Packet is not set for it.
+func WithReusedPayload() RouteOption {
+	return func(r *route) {
+		r.releasePacket = true
+	}
+}
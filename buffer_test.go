@@ -0,0 +1,156 @@
+package flyrpc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	assert.Equal(t, 0, bufferClass(1))
+	assert.Equal(t, 0, bufferClass(512))
+	assert.Equal(t, 1, bufferClass(513))
+	assert.Equal(t, maxBufferBits-minBufferBits, bufferClass(1<<maxBufferBits))
+	assert.Equal(t, -1, bufferClass(1<<maxBufferBits+1))
+
+	buf := getBuffer(600)
+	assert.Equal(t, 600, len(buf))
+	assert.Equal(t, 1024, cap(buf))
+	putBuffer(buf)
+	// not from the pool
+	putBuffer(make([]byte, 600))
+	big := getBuffer(1<<maxBufferBits + 1)
+	assert.Equal(t, 1<<maxBufferBits+1, len(big))
+	putBuffer(big)
+}
+
+// appendJSON is JSON marshaling into the given buffer.
+type appendJSON struct {
+	Serializer
+}
+
+func (s appendJSON) MarshalAppend(buf []byte, v interface{}) ([]byte, error) {
+	bytes, err := json.Marshal(v)
+	return append(buf, bytes...), err
+}
+
+func TestReusedPayload(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: appendJSON{JSON},
+	})
+	kept := make(chan []byte, 2)
+	server.OnMessage("keep", func(in []byte) []byte {
+		kept <- in
+		return in
+	})
+	server.OnMessage("borrow", func(pkt *Packet) []byte {
+		kept <- append([]byte{}, pkt.Payload...)
+		return pkt.Payload
+	}, WithReusedPayload())
+	server.OnMessage("user", func(in *TestUser) *TestUser {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15711")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15711")
+
+	for i := 0; i < 10; i++ {
+		u := &TestUser{}
+		assert.NoError(t, client.Call("user", &TestUser{Id: int32(i), Name: "n"}, u))
+		assert.Equal(t, int32(i), u.Id)
+	}
+	bytes, err := client.GetReply("keep", []byte("first"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(bytes))
+	bytes, err = client.GetReply("borrow", []byte("other"))
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(bytes))
+	// the kept payload is not reused
+	assert.Equal(t, "first", string(<-kept))
+	assert.Equal(t, "other", string(<-kept))
+	server.Close()
+}
+
+func TestContextPacketKept(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	contexts := make(chan *Context, 1)
+	server.OnMessage("user", func(ctx *Context, in *TestUser) *TestUser {
+		contexts <- ctx
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15712")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15712")
+
+	u := &TestUser{}
+	assert.NoError(t, client.Call("user", &TestUser{Id: 1, Name: "n"}, u))
+	ctx := <-contexts
+	// the handler returned, ctx.Packet is not released
+	pkt := ctx.Packet
+	assert.Equal(t, "user", pkt.Code)
+	assert.NoError(t, client.Call("user", &TestUser{Id: 2, Name: "n"}, u))
+	<-contexts
+	assert.Equal(t, "user", pkt.Code)
+	assert.Contains(t, string(pkt.Payload), `"id":1`)
+	server.Close()
+}
+
+func TestContextPacketShared(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	read := make(chan bool)
+	returned := make(chan bool)
+	seen := make(chan string, 1)
+	server.OnMessage("hold", func(ctx *Context, in *TestUser) {
+		switch in.Id {
+		case 1:
+			<-read
+			// the packet of the handler 2
+			ctx.lock.Lock()
+			pkt := ctx.Packet
+			ctx.lock.Unlock()
+			<-returned
+			seen <- string(pkt.Payload)
+		case 2:
+			<-returned
+		}
+	})
+	server.OnMessage("user", func(in *TestUser) *TestUser {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15713")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15713")
+
+	assert.NoError(t, client.SendMessage("hold", &TestUser{Id: 1, Name: "n"}))
+	<-time.After(10 * time.Millisecond)
+	assert.NoError(t, client.SendMessage("hold", &TestUser{Id: 2, Name: "n"}))
+	<-time.After(10 * time.Millisecond)
+	read <- true
+	<-time.After(10 * time.Millisecond)
+	assert.NoError(t, client.SendMessage("hold", &TestUser{Id: 3, Name: "n"}))
+	<-time.After(10 * time.Millisecond)
+	close(returned)
+	<-time.After(10 * time.Millisecond)
+	// pooled packets are reused meanwhile
+	for i := 10; i < 20; i++ {
+		u := &TestUser{}
+		assert.NoError(t, client.Call("user", &TestUser{Id: int32(i), Name: "n"}, u))
+	}
+	assert.Contains(t, <-seen, `"id":2`)
+	server.Close()
+}
@@ -0,0 +1,76 @@
+package flyrpc
+
+// Canceled is closed when the caller gives up a request with GetReplyCancel,
+// e.g. a hedged call which lost. A handler takes it as a param to stop early,
+// its reply is dropped by the caller anyway.
+type Canceled <-chan bool
+
+// request is a call of the peer until its handler returns.
+type request struct {
+	// done is made on demand by the Canceled param
+	done     chan bool
+	canceled bool
+}
+
+// startRequest tracks a call of the peer, before a CodeCancel may follow.
+func (ctx *Context) startRequest(seq TSeq) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.requests[seq] = &request{}
+}
+
+// endRequest forgets the call, it returns true if it was canceled.
+func (ctx *Context) endRequest(seq TSeq) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	r := ctx.requests[seq]
+	delete(ctx.requests, seq)
+	return r != nil && r.canceled
+}
+
+// isCanceled tells a queued call not to run.
+func (ctx *Context) isCanceled(seq TSeq) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	r := ctx.requests[seq]
+	return r != nil && r.canceled
+}
+
+// canceledOf returns the Canceled of a call, never closed if not tracked.
+func (ctx *Context) canceledOf(seq TSeq) Canceled {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	r := ctx.requests[seq]
+	if r == nil {
+		return make(chan bool)
+	}
+	if r.done == nil {
+		r.done = make(chan bool)
+		if r.canceled {
+			close(r.done)
+		}
+	}
+	return r.done
+}
+
+// emitCancel cancels the call of pkt.Seq, it runs in the reading goroutine.
+func (ctx *Context) emitCancel(pkt *Packet) {
+	seq := pkt.Seq
+	pkt.Release()
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	r := ctx.requests[seq]
+	if r == nil || r.canceled {
+		// replied already
+		return
+	}
+	r.canceled = true
+	if r.done != nil {
+		close(r.done)
+	}
+}
+
+// sendCancel tells the peer that the call of seq is given up.
+func (ctx *Context) sendCancel(seq TSeq) error {
+	return ctx.sendPacketPriority(0, CodeCancel, seq, []byte{}, PriorityControl)
+}
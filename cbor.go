@@ -0,0 +1,30 @@
+package flyrpc
+
+import (
+	"bytes"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOR serializes with CBOR (RFC 8949). Fields are named by their cbor tag, or
+// their json tag if none.
+var CBOR Serializer = &cborSerializer{}
+
+type cborSerializer struct{}
+
+func (s *cborSerializer) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+// MarshalAppend implements AppendSerializer.
+func (s *cborSerializer) MarshalAppend(buf []byte, v interface{}) ([]byte, error) {
+	w := bytes.NewBuffer(buf)
+	if err := cbor.MarshalToBuffer(v, w); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (s *cborSerializer) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
@@ -0,0 +1,135 @@
+package flyrpc
+
+import (
+	"io"
+)
+
+// ChunkSize is the payload size of the packets written by a stream Writer.
+// Other packets are interleaved between chunks.
+const ChunkSize = 32 * 1024
+
+type streamWriter struct {
+	s   *Stream
+	buf []byte
+}
+
+// Writer returns an io.WriteCloser splitting the bytes written into
+// ChunkSize packets of the stream. Close flushes and calls CloseSend.
+func (s *Stream) Writer() io.WriteCloser {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.writer == nil {
+		s.writer = &streamWriter{s: s, buf: make([]byte, 0, ChunkSize)}
+	}
+	return s.writer
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+		n += k
+		if len(w.buf) == cap(w.buf) {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush sends the buffered bytes as a chunk.
+func (w *streamWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.s.sendPriority(0, "", w.buf, PriorityBulk)
+	// SendPacket does not keep the payload, see Protocol
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *streamWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.s.CloseSend()
+}
+
+type streamReader struct {
+	s   *Stream
+	pkt *Packet
+	buf []byte
+}
+
+// Reader returns an io.Reader of the bytes received by the stream, it
+// returns io.EOF once the other side closed.
+func (s *Stream) Reader() io.Reader {
+	return &streamReader{s: s}
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.pkt != nil {
+			// read, reuse the chunk
+			r.pkt.Release()
+			r.pkt = nil
+		}
+		pkt, err := r.s.recvPacket()
+		if err != nil {
+			return 0, err
+		}
+		r.pkt = pkt
+		r.buf = pkt.Payload
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Upload sends the bytes of r in chunks to the handler of code, which takes
+// an io.Reader. It returns the error of the handler.
+func (ctx *Context) Upload(code string, r io.Reader) error {
+	s, err := ctx.OpenStream(code, []byte{})
+	if err != nil {
+		return err
+	}
+	w := s.Writer()
+	if _, err := io.Copy(w, r); err != nil {
+		s.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		s.Close()
+		return err
+	}
+	// wait the handler
+	for {
+		if _, err := s.RecvBytes(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Download copies to w the bytes written by the handler of code, which
+// takes an io.Writer. message is decoded as the handler message param.
+func (ctx *Context) Download(code string, message Message, w io.Writer) error {
+	s, err := ctx.OpenStream(code, message)
+	if err != nil {
+		return err
+	}
+	if err := s.CloseSend(); err != nil {
+		s.Close()
+		return err
+	}
+	if _, err = io.Copy(w, s.Reader()); err != nil {
+		// stop receiving if w failed
+		s.Close()
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package flyrpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkTransfer(t *testing.T) {
+	data := make([]byte, 10*ChunkSize+123)
+	rand.Read(data)
+
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	uploaded := make(chan []byte, 1)
+	server.OnMessage("upload", func(r io.Reader) error {
+		bytes, err := ioutil.ReadAll(r)
+		uploaded <- bytes
+		return err
+	})
+	server.OnMessage("download", func(in *TestUser, w io.Writer) error {
+		// small writes are merged into chunks
+		for i := 0; i < len(data); i += 1000 {
+			end := i + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := w.Write(data[i:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	server.OnMessage("download.fail", func(w io.Writer) error {
+		w.Write(data[:10])
+		return newError("FAIL")
+	})
+	server.OnMessage("hello", func(in *TestUser) *TestUser {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15681")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15681")
+
+	assert.NoError(t, client.Upload("upload", bytes.NewReader(data)))
+	assert.Equal(t, data, <-uploaded)
+
+	// calls are not blocked by the transfer
+	done := make(chan bool)
+	go func() {
+		u := &TestUser{}
+		for i := int32(0); i < 10; i++ {
+			assert.NoError(t, client.Call("hello", &TestUser{Id: i}, u))
+			assert.Equal(t, i, u.Id)
+		}
+		close(done)
+	}()
+	buf := &bytes.Buffer{}
+	assert.NoError(t, client.Download("download", &TestUser{}, buf))
+	assert.Equal(t, data, buf.Bytes())
+	<-done
+
+	buf.Reset()
+	err := client.Download("download.fail", nil, buf)
+	assert.Error(t, err)
+	assert.Equal(t, "FAIL", err.Error())
+	assert.Equal(t, data[:10], buf.Bytes())
+
+	server.Close()
+}
@@ -4,26 +4,119 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 // Client use to connect server.
 type Client struct {
 	// extend with *Context
 	*Context
+	// reconnect is set by DialReconnect
+	reconnect          *reconnectProtocol
+	handlersLock       sync.RWMutex
+	disconnectHandlers []func(error)
+	reconnectHandlers  []func()
 }
 
+// ReconnectOpts configures a Client created by DialReconnect.
+type ReconnectOpts struct {
+	// Backoff between dial attempts, default 100ms to 30s with 0.2 jitter
+	Backoff *Backoff
+	// MaxAttempts to redial before the Client closes, 0 for unlimited
+	MaxAttempts int
+	// RetryCalls resends pending calls once reconnected, otherwise they
+	// fail with ErrDisconnected. Calls still time out as usual.
+	RetryCalls bool
+	// Handshake runs on every new connection before OnReconnect handlers,
+	// an error drops the connection.
+	Handshake func(*Client) error
+	// MaxCodeLength of received packets, default DefaultMaxCodeLength
+	MaxCodeLength int
+	// MaxPayloadLength of received packets, default DefaultMaxPayloadLength.
+	// A bigger reply fails the call and closes the connection.
+	MaxPayloadLength TLength
+}
+
+// DialOpts configures DialWith.
+type DialOpts struct {
+	// MaxCodeLength of received packets, default DefaultMaxCodeLength
+	MaxCodeLength int
+	// MaxPayloadLength of received packets, default DefaultMaxPayloadLength.
+	// A bigger reply fails the call and closes the connection.
+	MaxPayloadLength TLength
+}
+
+// Dial connects to a server, received packets are limited to
+// DefaultMaxCodeLength and DefaultMaxPayloadLength.
 func Dial(network, address string) (*Client, error) {
-	conn, err := net.Dial(network, address)
+	return DialWith(network, address, nil)
+}
+
+// DialWith connects like Dial with the limits of opts.
+func DialWith(network, address string, opts *DialOpts) (*Client, error) {
+	if opts == nil {
+		opts = &DialOpts{}
+	}
+	protocol, err := dialProtocol(network, address, opts.MaxCodeLength, opts.MaxPayloadLength)
 	if err != nil {
 		return nil, err
 	}
-	var protocol Protocol
-	if network == "tcp" || network == "unix" {
-		protocol = NewTcpProtocol(conn, false)
-	} else {
+	return newClientWith(protocol, nil, func(c *Client) {
+		c.RemoteAddr = address
+	}), nil
+}
+
+// DialReconnect connects like Dial, the Client redials with backoff when the
+// connection is lost. Routes added with OnMessage are kept.
+func DialReconnect(network, address string, opts *ReconnectOpts) (*Client, error) {
+	if opts == nil {
+		opts = &ReconnectOpts{}
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = &Backoff{Jitter: 0.2}
+	}
+	current, err := dialProtocol(network, address, opts.MaxCodeLength, opts.MaxPayloadLength)
+	if err != nil {
+		return nil, err
+	}
+	protocol := &reconnectProtocol{
+		network:   network,
+		address:   address,
+		opts:      opts,
+		current:   current,
+		closeChan: make(chan bool),
+	}
+	cli := newClientWith(protocol, nil, func(c *Client) {
+		protocol.client = c
+		c.RemoteAddr = address
+		c.reconnect = protocol
+		c.retryCalls = opts.RetryCalls
+	})
+	if opts.Handshake != nil {
+		if err := opts.Handshake(cli); err != nil {
+			cli.Close()
+			return nil, err
+		}
+	}
+	return cli, nil
+}
+
+// dialProtocol connects with the given limits, 0 for the defaults.
+func dialProtocol(network, address string, maxCodeLength int, maxPayloadLength TLength) (Protocol, error) {
+	if network != "tcp" && network != "unix" {
 		return nil, newError("not support protocol " + network)
 	}
-	return newClient(protocol, nil), nil
+	if err := checkLimits(maxCodeLength); err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	protocol := NewTcpProtocol(conn, false)
+	protocol.setLimits(maxCodeLength, maxPayloadLength)
+	return protocol, nil
 }
 
 func newTcpClient(conn net.Conn, serializer Serializer) *Client {
@@ -33,21 +126,34 @@ func newTcpClient(conn net.Conn, serializer Serializer) *Client {
 
 // Create new Client instance.
 func newClient(protocol Protocol, serializer Serializer) *Client {
+	return newClientWith(protocol, serializer, nil)
+}
+
+// newClientWith calls init before the Client starts reading packets.
+func newClientWith(protocol Protocol, serializer Serializer, init func(*Client)) *Client {
 	if serializer == nil {
 		serializer = JSON
 	}
 	router := NewRouter(serializer)
 	context := NewContext(protocol, router, 99, serializer)
 	cli := &Client{
-		context,
+		Context: context,
+	}
+	if init != nil {
+		init(cli)
 	}
 	go cli.handlePackets()
 	return cli
 }
 
+// SetSerializer swaps the serializer of the Client, it is safe while calls
+// and handlers run. The server is not told, see UseSerializer.
 func (c *Client) SetSerializer(serializer Serializer) {
-	c.serializer = serializer
-	c.Router.(*router).serializer = serializer
+	if serializer == nil {
+		panic("require serializer")
+	}
+	c.setSerializer(serializer, "")
+	c.Router.SetSerializer(serializer)
 }
 
 func (c *Client) handlePackets() {
@@ -57,18 +163,182 @@ func (c *Client) handlePackets() {
 			if err != io.EOF {
 				log.Println("Close on error", err)
 			}
+			if c.reconnect == nil {
+				c.emitDisconnect(err)
+			}
 			c.Close()
 			break
 		}
-		go c.emitPacket(packet)
+		c.dispatchPacket(packet)
 	}
 }
 
-func (c *Client) OnMessage(code string, handler HandlerFunc) {
-	c.Router.AddRoute(code, handler)
+func (c *Client) OnMessage(code string, handler HandlerFunc, opts ...RouteOption) {
+	c.Router.AddRoute(code, handler, opts...)
+}
+
+// OnDisconnect is called when the connection is lost. A reconnecting Client
+// calls it on every lost connection.
+func (c *Client) OnDisconnect(handler func(error)) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.disconnectHandlers = append(c.disconnectHandlers, handler)
+}
+
+// OnReconnect is called when a reconnecting Client is connected again and
+// the handshake is done.
+func (c *Client) OnReconnect(handler func()) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+	c.reconnectHandlers = append(c.reconnectHandlers, handler)
+}
+
+func (c *Client) emitDisconnect(err error) {
+	c.handlersLock.RLock()
+	defer c.handlersLock.RUnlock()
+	for _, handler := range c.disconnectHandlers {
+		go handler(err)
+	}
+}
+
+func (c *Client) emitReconnect() {
+	c.handlersLock.RLock()
+	defer c.handlersLock.RUnlock()
+	for _, handler := range c.reconnectHandlers {
+		go handler()
+	}
 }
 
 func (c *Client) Close() error {
 	c.Context.Close()
 	return c.Protocol.Close()
 }
+
+// reconnectProtocol hides lost connections from the Client, ReadPacket
+// redials until it gets a packet or gives up.
+type reconnectProtocol struct {
+	network   string
+	address   string
+	opts      *ReconnectOpts
+	client    *Client
+	lock      sync.RWMutex
+	current   Protocol
+	closed    bool
+	closeChan chan bool
+}
+
+func (p *reconnectProtocol) get() Protocol {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.current
+}
+
+func (p *reconnectProtocol) isClosed() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.closed
+}
+
+func (p *reconnectProtocol) SendPacket(pkt *Packet) error {
+	current := p.get()
+	if current == nil {
+		return newError(ErrDisconnected)
+	}
+	return current.SendPacket(pkt)
+}
+
+func (p *reconnectProtocol) ReadPacket() (*Packet, error) {
+	for {
+		current := p.get()
+		pkt, err := current.ReadPacket()
+		if err == nil {
+			return pkt, nil
+		}
+		if p.isClosed() {
+			return nil, err
+		}
+		p.disconnect(current, err)
+		if err := p.redial(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *reconnectProtocol) disconnect(current Protocol, err error) {
+	p.lock.Lock()
+	if p.current == current {
+		p.current = nil
+	}
+	p.lock.Unlock()
+	current.Close()
+	log.Println("Disconnected", p.address, err)
+	if !p.opts.RetryCalls {
+		p.client.failCalls(ErrDisconnected)
+	}
+	p.client.failStreams(ErrDisconnected)
+	p.client.credits.reset()
+	p.client.emitDisconnect(err)
+}
+
+// redial blocks until connected, closed or MaxAttempts reached.
+func (p *reconnectProtocol) redial() error {
+	for attempt := 0; p.opts.MaxAttempts == 0 || attempt < p.opts.MaxAttempts; attempt++ {
+		select {
+		case <-p.closeChan:
+			return newError(ErrWriterClosed)
+		case <-time.After(p.opts.Backoff.Duration(attempt)):
+		}
+		current, err := dialProtocol(p.network, p.address, p.opts.MaxCodeLength, p.opts.MaxPayloadLength)
+		if err != nil {
+			continue
+		}
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			current.Close()
+			return newError(ErrWriterClosed)
+		}
+		p.current = current
+		p.lock.Unlock()
+		go p.reconnected(current)
+		return nil
+	}
+	return newError(ErrDisconnected)
+}
+
+// reconnected runs the handshake while ReadPacket already reads replies.
+func (p *reconnectProtocol) reconnected(current Protocol) {
+	if err := p.client.renegotiate(); err != nil {
+		log.Println("Serializer error", p.address, err)
+		current.Close()
+		return
+	}
+	if p.opts.Handshake != nil {
+		if err := p.opts.Handshake(p.client); err != nil {
+			log.Println("Handshake error", p.address, err)
+			current.Close()
+			return
+		}
+	}
+	if flow := p.client.getFlow(); flow != nil {
+		flow.grant()
+	}
+	if p.opts.RetryCalls {
+		p.client.resendCalls()
+	}
+	p.client.emitReconnect()
+}
+
+func (p *reconnectProtocol) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.closeChan)
+	if p.current != nil {
+		return p.current.Close()
+	}
+	return nil
+}
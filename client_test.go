@@ -0,0 +1,243 @@
+package flyrpc
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	assert.Equal(t, 10*time.Millisecond, b.Duration(0))
+	assert.Equal(t, 20*time.Millisecond, b.Duration(1))
+	assert.Equal(t, 40*time.Millisecond, b.Duration(2))
+	assert.Equal(t, 50*time.Millisecond, b.Duration(3))
+	b.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := b.Duration(1)
+		assert.True(t, d > 10*time.Millisecond && d <= 20*time.Millisecond)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	contexts := make(chan *Context, 2)
+	server.OnConnect(func(ctx *Context) {
+		contexts <- ctx
+	})
+	server.OnMessage("hello", func(name string) string {
+		return "hello:" + name
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15631")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	handshakes := int32(0)
+	client, err := DialReconnect("tcp", "127.0.0.1:15631", &ReconnectOpts{
+		Backoff: &Backoff{Min: 10 * time.Millisecond},
+		Handshake: func(c *Client) error {
+			atomic.AddInt32(&handshakes, 1)
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+	client.OnMessage("echo", func(in string) string {
+		return in
+	})
+	disconnected := make(chan error, 1)
+	client.OnDisconnect(func(err error) {
+		disconnected <- err
+	})
+	reconnected := make(chan bool, 1)
+	client.OnReconnect(func() {
+		reconnected <- true
+	})
+	ctx := <-contexts
+
+	// drop the connection from server side
+	ctx.Close()
+	<-disconnected
+	<-reconnected
+	assert.Equal(t, int32(2), atomic.LoadInt32(&handshakes))
+
+	bytes, err := client.GetReply("hello", "world")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello:world", string(bytes))
+
+	// routes are kept
+	ctx = <-contexts
+	bytes, err = ctx.GetReply("echo", "again")
+	assert.NoError(t, err)
+	assert.Equal(t, "again", string(bytes))
+
+	client.Close()
+	server.Close()
+}
+
+func TestClientLimits(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	server.OnMessage("echo", func(in []byte) []byte {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15634")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	client, err := DialReconnect("tcp", "127.0.0.1:15634", &ReconnectOpts{
+		Backoff:          &Backoff{Min: 10 * time.Millisecond},
+		MaxPayloadLength: 10,
+	})
+	assert.NoError(t, err)
+	reconnected := make(chan bool, 1)
+	client.OnReconnect(func() {
+		reconnected <- true
+	})
+	_, err = client.GetReply("echo", make([]byte, 10))
+	assert.NoError(t, err)
+
+	// a bigger reply drops the connection
+	_, err = client.GetReply("echo", make([]byte, 11))
+	assert.Error(t, err)
+	<-reconnected
+
+	// the limit is kept by the new connection
+	_, err = client.GetReply("echo", make([]byte, 11))
+	assert.Error(t, err)
+	client.Close()
+	server.Close()
+}
+
+func TestDialWith(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	server.OnMessage("echo", func(in []byte) []byte {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15635")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	client, err := DialWith("tcp", "127.0.0.1:15635", &DialOpts{MaxPayloadLength: 10})
+	assert.NoError(t, err)
+	_, err = client.GetReply("echo", make([]byte, 10))
+	assert.NoError(t, err)
+	_, err = client.GetReply("echo", make([]byte, 11))
+	assert.Error(t, err)
+	client.Close()
+
+	// codes are read in a buffer of MaxCodeLengthLimit
+	_, err = DialWith("tcp", "127.0.0.1:15635", &DialOpts{MaxCodeLength: MaxCodeLengthLimit + 1})
+	assert.Error(t, err)
+	assert.Panics(t, func() {
+		NewServer(&ServerOpts{MaxCodeLength: MaxCodeLengthLimit + 1})
+	})
+	server.Close()
+}
+
+func TestClientReconnectPendingCalls(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	calls := int32(0)
+	server.OnMessage("once", func(ctx *Context) string {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// lose the first call
+			ctx.Close()
+			return ""
+		}
+		return "done"
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15632")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	client, err := DialReconnect("tcp", "127.0.0.1:15632", &ReconnectOpts{
+		Backoff: &Backoff{Min: 10 * time.Millisecond},
+	})
+	assert.NoError(t, err)
+	_, err = client.GetReply("once", nil)
+	assert.Error(t, err)
+	assert.Equal(t, ErrDisconnected, err.Error())
+	client.Close()
+
+	atomic.StoreInt32(&calls, 0)
+	client, err = DialReconnect("tcp", "127.0.0.1:15632", &ReconnectOpts{
+		Backoff:    &Backoff{Min: 10 * time.Millisecond},
+		RetryCalls: true,
+	})
+	assert.NoError(t, err)
+	bytes, err := client.GetReply("once", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "done", string(bytes))
+	client.Close()
+	server.Close()
+}
+
+// wrappedRouter is a custom Router
+type wrappedRouter struct {
+	Router
+}
+
+func TestClientSetSerializer(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Order:      Sequential,
+	})
+	server.OnMessage("hello", func(in *TestUser) *TestUser {
+		return &TestUser{Id: in.Id, Name: "hello:" + in.Name}
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15633")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	protocol, err := dialProtocol("tcp", "127.0.0.1:15633", 0, 0)
+	assert.NoError(t, err)
+	client := newClientWith(protocol, JSON, func(c *Client) {
+		c.Router = &wrappedRouter{c.Router}
+	})
+
+	// swapped while calls run
+	wg := sync.WaitGroup{}
+	for i := int32(0); i < 4; i++ {
+		wg.Add(1)
+		go func(i int32) {
+			defer wg.Done()
+			for j := int32(0); j < 20; j++ {
+				u := &TestUser{}
+				assert.NoError(t, client.Call("hello", &TestUser{Id: i, Name: "a"}, u))
+				assert.Equal(t, TestUser{Id: i, Name: "hello:a"}, *u)
+			}
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		client.SetSerializer(NewSerializer(json.Marshal, json.Unmarshal))
+		client.OnMessage("echo", func(in string) string {
+			return in
+		})
+	}
+	wg.Wait()
+	assert.Panics(t, func() {
+		client.SetSerializer(nil)
+	})
+
+	client.Close()
+	server.Close()
+}
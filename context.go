@@ -2,34 +2,88 @@ package flyrpc
 
 import (
 	"log"
+	"sync"
 	"time"
 )
 
+// Caller is the calling API shared by *Context, *Client and *Pool.
+type Caller interface {
+	SendMessage(code string, message Message, opts ...CallOption) error
+	GetReply(code string, message Message, opts ...CallOption) ([]byte, error)
+	Call(code string, message Message, reply Message, opts ...CallOption) error
+}
+
+// Invoker sends a call and waits for the reply payload.
+type Invoker func(ctx *Context, code string, payload []byte) ([]byte, error)
+
+// Interceptor wraps the calls of a Context, it may call invoke any times.
+type Interceptor func(ctx *Context, code string, payload []byte, invoke Invoker) ([]byte, error)
+
 type Context struct {
 	Protocol Protocol
 	Debug    bool
 	Tag      string
 	ClientId int
-	Session  interface{}
-	Packet   *Packet
-	Router   Router
+	// RemoteAddr of the end-user, reported by the gateway in multiplex mode
+	RemoteAddr string
+	Session    interface{}
+	// Packet is the last request received by a handler taking the Context,
+	// it is not pooled. Concurrent handlers see each other's packets, take a
+	// *Packet param to get the own one.
+	Packet *Packet
+	Router Router
 	// private
 	serializer Serializer
-	nextSeq    TSeq
-	replyChans map[TSeq]chan *Packet
-	timeout    time.Duration
+	// serializers the peer may switch to, nil for any registered one
+	serializers []string
+	// serializerName is set once negotiated, see UseSerializer
+	serializerName string
+	nextSeq        TSeq
+	calls          map[TSeq]*pendingCall
+	lock           sync.Mutex
+	// streams opened by us and by the peer
+	streams         map[TSeq]*Stream
+	acceptedStreams map[TSeq]*Stream
+	// requests of the peer being handled, see Canceled
+	requests map[TSeq]*request
+	// switching is held while the serializer switches, and read by the
+	// senders of encoded packets, see UseSerializer
+	switching sync.RWMutex
+	// serializerGen counts the switches, a call encoded before is encoded
+	// again
+	serializerGen int
+	// retryCalls keeps calls pending when the packet can not be sent
+	retryCalls   bool
+	interceptors []Interceptor
+	// flow bounds our handlers, credits bound our requests
+	flow    *flowControl
+	credits *credits
+	// order of the handlers, orderQueues the packets waiting for the worker
+	// of each key
+	order       OrderKey
+	orderQueues map[string][]func()
+	// validator of the decoded messages
+	validator ValidateFunc
+	timeout   time.Duration
 	// close handler
 	closeHandler func(*Context)
+	closeOnce    sync.Once
 }
 
 func NewContext(protocol Protocol, router Router, clientId int, serializer Serializer) *Context {
 	return &Context{
-		Protocol:   protocol,
-		Router:     router,
-		ClientId:   clientId,
-		serializer: serializer,
-		replyChans: make(map[TSeq]chan *Packet),
-		timeout:    10 * time.Second,
+		Protocol:        protocol,
+		Router:          router,
+		ClientId:        clientId,
+		serializer:      serializer,
+		calls:           make(map[TSeq]*pendingCall),
+		streams:         make(map[TSeq]*Stream),
+		acceptedStreams: make(map[TSeq]*Stream),
+		requests:        make(map[TSeq]*request),
+		serializerGen:   1,
+		credits:         newCredits(),
+		orderQueues:     make(map[string][]func()),
+		timeout:         10 * time.Second,
 	}
 }
 
@@ -43,17 +97,22 @@ func (ctx *Context) debug(args ...interface{}) {
 }
 
 func (ctx *Context) sendPacket(flag byte, code string, seq TSeq, payload []byte) error {
+	return ctx.sendPacketPriority(flag, code, seq, payload, PriorityInteractive)
+}
+
+func (ctx *Context) sendPacketPriority(flag byte, code string, seq TSeq, payload []byte, priority Priority) error {
 	return ctx.Protocol.SendPacket(&Packet{
 		ClientId: ctx.ClientId,
 		Flag:     flag,
 		Code:     code,
 		Seq:      seq,
 		Payload:  payload,
+		Priority: priority,
 	})
 }
 
 func (ctx *Context) sendError(code string, seq TSeq, err error) error {
-	payload := []byte{}
+	payload := errorPayload(err)
 	return ctx.sendPacket(
 		FlagResponse,
 		err.Error(),
@@ -62,40 +121,118 @@ func (ctx *Context) sendError(code string, seq TSeq, err error) error {
 	)
 }
 
-func (ctx *Context) SendMessage(code string, message Message) error {
-	payload, err := MessageToBytes(message, ctx.serializer)
+func (ctx *Context) SendMessage(code string, message Message, opts ...CallOption) error {
+	if err := ctx.credits.acquire(nil, nil); err != nil {
+		return err
+	}
+	// sent with the serializer it is encoded with, see UseSerializer
+	ctx.switching.RLock()
+	defer ctx.switching.RUnlock()
+	payload, pooled, err := messageToBuffer(message, ctx.Serializer())
 	if err != nil {
+		ctx.credits.refund()
 		return err
 	}
-	return ctx.sendPacket(FlagWaitResponse, code, ctx.getNextSeq(), payload)
+	if pooled {
+		defer putBuffer(payload)
+	}
+	o := newCallOpts(opts)
+	return ctx.sendPacketPriority(FlagWaitResponse, code, ctx.getNextSeq(), payload, o.priority)
 }
 
-func (ctx *Context) GetReply(code string, message Message) ([]byte, error) {
+func (ctx *Context) GetReply(code string, message Message, opts ...CallOption) ([]byte, error) {
+	return ctx.GetReplyCancel(code, message, nil, opts...)
+}
+
+// GetReplyCancel is GetReply, it returns ErrCanceled as soon as cancel is
+// closed. The late reply is dropped.
+func (ctx *Context) GetReplyCancel(code string, message Message, cancel <-chan bool, opts ...CallOption) ([]byte, error) {
 	ctx.debug("Call", code, message)
 
-	payload, err := MessageToBytes(message, ctx.serializer)
-	if err != nil {
-		return nil, err
+	o := newCallOpts(opts)
+	o.cancel = cancel
+	ctx.lock.Lock()
+	interceptors := ctx.interceptors
+	ctx.lock.Unlock()
+	for {
+		serializer, gen := ctx.currentSerializer()
+		payload, err := MessageToBytes(message, serializer)
+		if err != nil {
+			return nil, err
+		}
+		o.gen = gen
+		bytes, err := invokeChain(interceptors, o)(ctx, code, payload)
+		if err != nil && err.Error() == errSerializerChanged {
+			// switched while intercepted, encode it again
+			continue
+		}
+		return bytes, err
 	}
-	packet := &Packet{
-		Flag:    FlagWaitResponse,
-		Code:    code,
-		Seq:     ctx.getNextSeq(),
-		Payload: payload,
+}
+
+// Use adds interceptors to the calls of the Context, the first one added
+// is the outermost. Calls already running keep their interceptors.
+func (ctx *Context) Use(interceptors ...Interceptor) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.interceptors = append(ctx.interceptors[:len(ctx.interceptors):len(ctx.interceptors)], interceptors...)
+}
+
+// invokeChain returns the Invoker of the first of interceptors.
+func invokeChain(interceptors []Interceptor, opts *callOpts) Invoker {
+	if len(interceptors) == 0 {
+		return func(ctx *Context, code string, payload []byte) ([]byte, error) {
+			return ctx.getReply(code, payload, ctx.timeout, opts)
+		}
 	}
+	interceptor, next := interceptors[0], invokeChain(interceptors[1:], opts)
+	return func(ctx *Context, code string, payload []byte) ([]byte, error) {
+		return interceptor(ctx, code, payload, next)
+	}
+}
 
-	// Send Packet
-	if err := ctx.Protocol.SendPacket(packet); err != nil {
-		return nil, err
+func (ctx *Context) getReply(code string, payload []byte, timeout time.Duration, opts *callOpts) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	encoded := !isControlCode(code)
+	if encoded {
+		if err := ctx.credits.acquire(timer.C, opts.cancel); err != nil {
+			return nil, err
+		}
+		// sent with the serializer it is encoded with, see UseSerializer
+		ctx.switching.RLock()
+		if _, gen := ctx.currentSerializer(); opts.gen != 0 && opts.gen != gen {
+			ctx.switching.RUnlock()
+			ctx.credits.refund()
+			return nil, newError(errSerializerChanged)
+		}
+	}
+	packet := &Packet{
+		ClientId: ctx.ClientId,
+		Flag:     FlagWaitResponse,
+		Code:     code,
+		Seq:      ctx.getNextSeq(),
+		Payload:  payload,
+		Priority: opts.priority,
 	}
 
 	// init channel before send packet
 	replyChan := make(chan *Packet, 1)
 	// set replyChan for code | seq
-	ctx.replyChans[packet.Seq] = replyChan
+	ctx.setCall(packet.Seq, &pendingCall{packet, replyChan, opts.switchTo})
 
 	// make sure that replyChan is released
-	defer delete(ctx.replyChans, packet.Seq)
+	defer ctx.setCall(packet.Seq, nil)
+
+	// Send Packet
+	err := ctx.Protocol.SendPacket(packet)
+	if encoded {
+		ctx.switching.RUnlock()
+	}
+	if err != nil && !ctx.retryCalls {
+		return nil, err
+	}
+
 	select {
 	case rPacket := <-replyChan:
 		ctx.debug("reply payload", rPacket.Payload)
@@ -105,18 +242,28 @@ func (ctx *Context) GetReply(code string, message Message) ([]byte, error) {
 		}
 		return rPacket.Payload, nil
 
-	case <-time.After(ctx.timeout):
+	case <-timer.C:
 		return nil, newError(ErrTimeOut)
+
+	case <-opts.cancel:
+		ctx.sendCancel(packet.Seq)
+		return nil, newError(ErrCanceled)
 	}
 }
 
-func (ctx *Context) Call(code string, message Message, reply Message) error {
-	bytes, err := ctx.GetReply(code, message)
+// Ping sends length bytes to the peer and waits the echo.
+func (ctx *Context) Ping(length int, timeout time.Duration) error {
+	_, err := ctx.getReply(CodePing, make([]byte, length), timeout, &callOpts{priority: PriorityControl})
+	return err
+}
+
+func (ctx *Context) Call(code string, message Message, reply Message, opts ...CallOption) error {
+	bytes, err := ctx.GetReply(code, message, opts...)
 	if err != nil {
 		return err
 	}
 	if reply != nil {
-		return ctx.serializer.Unmarshal(bytes, reply)
+		return ctx.Serializer().Unmarshal(bytes, reply)
 	}
 	return nil
 }
@@ -132,36 +279,177 @@ func (ctx *Context) GetAsync(code string, message Message) (chan<- []byte, chan<
 	return buffChan, errChan
 }
 
+// dispatchPacket is called by the reading goroutine for every packet.
+func (ctx *Context) dispatchPacket(pkt *Packet) {
+	if pkt.Flag&FlagStream != 0 {
+		ctx.emitStreamPacket(pkt)
+		return
+	}
+	if pkt.Flag&FlagResponse != 0 {
+		// never blocks, and a reply is not lost to a following disconnect
+		ctx.emitPacket(pkt)
+		return
+	}
+	if pkt.Code == CodeCredit {
+		ctx.emitCredit(pkt)
+		return
+	}
+	if pkt.Code == CodeSerializer {
+		// the following packets use it
+		ctx.emitSerializer(pkt)
+		return
+	}
+	if pkt.Code == CodeCancel {
+		ctx.emitCancel(pkt)
+		return
+	}
+	if isControlCode(pkt.Code) {
+		go ctx.emitPacket(pkt)
+		return
+	}
+	if pkt.Flag&FlagWaitResponse != 0 {
+		ctx.startRequest(pkt.Seq)
+	}
+	// decoded with the serializer it was encoded with, even if the handler
+	// runs after a switch
+	pkt.serializer = ctx.Serializer()
+	ctx.runHandler(pkt)
+}
+
 func (ctx *Context) emitPacket(pkt *Packet) {
 	if pkt.Flag&FlagResponse != 0 {
-		replyChan := ctx.replyChans[pkt.Seq]
-		if replyChan == nil {
+		ctx.lock.Lock()
+		call := ctx.calls[pkt.Seq]
+		ctx.lock.Unlock()
+		if call == nil {
 			ctx.debug("No channel found, pkt is :", pkt)
 			return
 		}
-		replyChan <- pkt
+		if call.switchTo != nil && pkt.Code == "" {
+			// in the reading goroutine, the following packets use it
+			ctx.setSerializer(call.switchTo.serializer, call.switchTo.name)
+		}
+		select {
+		case call.replyChan <- pkt:
+		default:
+			// already replied
+		}
 		return
 	}
-	ctx.Packet = pkt
+	if pkt.Code == CodePing {
+		replyPing(ctx.Protocol, pkt)
+		return
+	}
+	if pkt.Flag&FlagWaitResponse != 0 {
+		defer ctx.endRequest(pkt.Seq)
+		if ctx.isCanceled(pkt.Seq) {
+			// given up while queued
+			pkt.Release()
+			return
+		}
+	}
 	ctx.debug("OnMessage", pkt.Code, pkt.Flag, pkt.Payload)
 	if err := ctx.Router.emitPacket(ctx, pkt); err != nil {
 		ctx.debug("Error to call packet", err)
 	}
 }
 
+// setPacket exposes pkt as ctx.Packet, it must not be released after.
+func (ctx *Context) setPacket(pkt *Packet) {
+	ctx.lock.Lock()
+	ctx.Packet = pkt
+	ctx.lock.Unlock()
+}
+
+// releasePacket releases a handled packet, unless it is ctx.Packet and may be
+// read after the handler returned.
+func (ctx *Context) releasePacket(pkt *Packet) {
+	ctx.lock.Lock()
+	kept := ctx.Packet == pkt
+	ctx.lock.Unlock()
+	if !kept {
+		pkt.Release()
+	}
+}
+
 func (ctx *Context) getNextSeq() TSeq {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
 	ctx.nextSeq++
 	return ctx.nextSeq
 }
 
+// pendingCall is a call waiting for its reply.
+type pendingCall struct {
+	packet    *Packet
+	replyChan chan *Packet
+	// switchTo is set for CodeSerializer, its reply switches
+	switchTo *serializerSwitch
+}
+
+func (ctx *Context) setCall(seq TSeq, call *pendingCall) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if call == nil {
+		delete(ctx.calls, seq)
+	} else {
+		ctx.calls[seq] = call
+	}
+}
+
+// NumPending returns the count of calls waiting for a reply.
+func (ctx *Context) NumPending() int {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return len(ctx.calls)
+}
+
+func (ctx *Context) pendingCalls() []*pendingCall {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	calls := make([]*pendingCall, 0, len(ctx.calls))
+	for _, call := range ctx.calls {
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// failCalls replies code as error to every pending call.
+func (ctx *Context) failCalls(code string) {
+	for _, call := range ctx.pendingCalls() {
+		ctx.emitPacket(&Packet{
+			Flag: FlagResponse,
+			Code: code,
+			Seq:  call.packet.Seq,
+		})
+	}
+}
+
+// resendCalls sends every pending call again, e.g. after a reconnection.
+func (ctx *Context) resendCalls() {
+	for _, call := range ctx.pendingCalls() {
+		if err := ctx.Protocol.SendPacket(call.packet); err != nil {
+			ctx.debug("Resend error", call.packet.Code, err)
+		}
+	}
+}
+
 func (ctx *Context) OnClose(handler func(*Context)) {
 	ctx.closeHandler = handler
 }
 
 func (ctx *Context) Close() {
-	ctx.debug("closing")
-	ctx.Protocol.Close()
-	if ctx.closeHandler != nil {
-		ctx.closeHandler(ctx)
-	}
+	ctx.closeOnce.Do(func() {
+		ctx.debug("closing")
+		ctx.Protocol.Close()
+		ctx.failCalls(ErrDisconnected)
+		ctx.failStreams(ErrDisconnected)
+		ctx.credits.reset()
+		if flow := ctx.getFlow(); flow != nil {
+			flow.close()
+		}
+		if ctx.closeHandler != nil {
+			ctx.closeHandler(ctx)
+		}
+	})
 }
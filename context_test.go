@@ -162,7 +162,7 @@ func TestCallTimeout(t *testing.T) {
 }
 
 func TestPing(t *testing.T) {
-	protocol := NewMockDelayProtocol(50 * time.Millisecond)
+	protocol := NewMockDelayProtocol(time.Millisecond)
 	serializer := JSON
 	router := NewRouter(serializer)
 	context := NewContext(protocol, router, 0, serializer)
@@ -176,5 +176,21 @@ func TestPing(t *testing.T) {
 			}
 		}
 	}()
+	assert.NoError(t, context.Ping(10, 200*time.Millisecond))
+}
 
+func TestCallCancel(t *testing.T) {
+	protocol := NewMockDelayProtocol(time.Second)
+	serializer := JSON
+	router := NewRouter(serializer)
+	context := NewContext(protocol, router, 0, serializer)
+	cancel := make(chan bool)
+	go func() {
+		<-time.After(10 * time.Millisecond)
+		close(cancel)
+	}()
+	_, err := context.GetReplyCancel("hello", "world", cancel)
+	assert.Error(t, err)
+	assert.Equal(t, ErrCanceled, err.Error())
+	assert.Equal(t, 0, context.NumPending())
 }
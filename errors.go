@@ -1,7 +1,7 @@
 /*
 FlyRPC provide a flexiable way to communicate between Server and Client.
 
-It support JSON, Msgpack, Protobuf serializer.
+It support JSON, Msgpack, Protobuf, CBOR, gob serializer.
 
 It support Call/Response  or Send/Receive pattern.
 */
@@ -11,13 +11,21 @@ import "errors"
 
 const (
 	// Common error
-	ErrTimeOut string = "TIMEOUT"
+	ErrTimeOut      string = "TIMEOUT"
+	ErrDisconnected string = "DISCONNECTED"
+	ErrCircuitOpen  string = "CIRCUIT_OPEN"
+	ErrCanceled     string = "CANCELED"
+	ErrStreamClosed string = "STREAM_CLOSED"
+	// ErrTooManyRequests rejects requests over FlowOpts.MaxConcurrent
+	ErrTooManyRequests string = "TOO_MANY_REQUESTS"
 
 	// 10000 - 20000 client error
 
 	ErrNotFound       string = "NOT_FOUND"
 	ErrUnknownSubType string = "UNKNOWN_SUB_TYPE"
 	ErrBuffTooLong    string = "BUFF_TOO_LONG"
+	// ErrInvalidArgument rejects a message, see InvalidArgument
+	ErrInvalidArgument string = "INVALID_ARGUMENT"
 	// 20000 + server error
 
 	ErrNoWriter     string = "NO_WRITER"
@@ -26,6 +34,8 @@ const (
 	// 25000 + serializer error
 
 	ErrNotProtoMessage string = "NOT_PROTOBUF_MESSAGE"
+	// ErrUnknownSerializer rejects a name missing from RegisterSerializer
+	ErrUnknownSerializer string = "UNKNOWN_SERIALIZER"
 )
 
 type ReplyError struct {
@@ -0,0 +1,290 @@
+package flyrpc
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// LimitPolicy is what a connection does with requests over MaxConcurrent.
+type LimitPolicy int
+
+const (
+	// LimitQueue queues requests up to QueueSize, then holds them like
+	// LimitStopReading.
+	LimitQueue LimitPolicy = iota
+	// LimitReject replies ErrTooManyRequests.
+	LimitReject
+	// LimitStopReading holds the request until a handler returns. Replies
+	// are still read meanwhile, the connection stops at the next request.
+	LimitStopReading
+)
+
+// FlowOpts bounds the handlers running for one connection. The peer is
+// granted MaxConcurrent credits with CodeCredit and waits for more before
+// sending requests over it. Peers ignoring credits hit the Policy.
+type FlowOpts struct {
+	// MaxConcurrent handlers, default 64
+	MaxConcurrent int
+	// QueueSize of LimitQueue, default 1024
+	QueueSize int
+	Policy    LimitPolicy
+}
+
+// flowControl runs the handlers of a Context within FlowOpts.
+type flowControl struct {
+	ctx    *Context
+	opts   FlowOpts
+	lock   sync.Mutex
+	cond   *sync.Cond
+	active int
+	queue  []*Packet
+	// held is the request over the limit, it runs before the next ones
+	held *Packet
+	// returned counts handled requests not yet granted back
+	returned int
+	closed   bool
+}
+
+// SetFlowControl bounds the handlers run for the peer and grants it the
+// credits, nil removes the bound.
+func (ctx *Context) SetFlowControl(opts *FlowOpts) error {
+	var flow *flowControl
+	if opts != nil {
+		flow = &flowControl{ctx: ctx, opts: *opts}
+		flow.cond = sync.NewCond(&flow.lock)
+		if flow.opts.MaxConcurrent <= 0 {
+			flow.opts.MaxConcurrent = 64
+		}
+		if flow.opts.QueueSize <= 0 {
+			flow.opts.QueueSize = 1024
+		}
+	}
+	ctx.lock.Lock()
+	old := ctx.flow
+	ctx.flow = flow
+	ctx.lock.Unlock()
+	if old != nil {
+		old.close()
+	}
+	if flow == nil {
+		return ctx.sendCredit(0)
+	}
+	return flow.grant()
+}
+
+func (ctx *Context) getFlow() *flowControl {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.flow
+}
+
+// runHandler runs the handler of a request within the flow control, it
+// blocks the reading goroutine when the peer ignores credits.
+func (ctx *Context) runHandler(pkt *Packet) {
+	flow := ctx.getFlow()
+	if flow == nil {
+		ctx.schedule(pkt, nil)
+		return
+	}
+	flow.dispatch(pkt)
+}
+
+// grant sends the peer all its credits again, e.g. once reconnected.
+func (f *flowControl) grant() error {
+	f.lock.Lock()
+	f.returned = 0
+	f.lock.Unlock()
+	return f.ctx.sendCredit(f.opts.MaxConcurrent)
+}
+
+// dispatch runs on the reading goroutine. A request over the limit is held
+// so that replies to the running handlers are still read, the reading only
+// waits when another request comes while one is held.
+func (f *flowControl) dispatch(pkt *Packet) {
+	f.lock.Lock()
+	for f.held != nil && !f.closed {
+		f.cond.Wait()
+	}
+	if f.active < f.opts.MaxConcurrent || f.closed {
+		f.active++
+		f.ctx.schedule(pkt, f.finish)
+		f.lock.Unlock()
+		return
+	}
+	switch f.opts.Policy {
+	case LimitReject:
+		f.lock.Unlock()
+		f.reject(pkt)
+		return
+	case LimitQueue:
+		if len(f.queue) < f.opts.QueueSize {
+			f.queue = append(f.queue, pkt)
+			f.lock.Unlock()
+			return
+		}
+	}
+	f.held = pkt
+	f.lock.Unlock()
+}
+
+// finish frees the slot of a handled request for the next queued one. The
+// requests are scheduled under the lock, in the order received.
+func (f *flowControl) finish() {
+	f.lock.Lock()
+	if len(f.queue) > 0 {
+		next := f.queue[0]
+		f.queue[0] = nil
+		f.queue = f.queue[1:]
+		if f.held != nil {
+			f.queue = append(f.queue, f.held)
+			f.held = nil
+		}
+		f.ctx.schedule(next, f.finish)
+	} else if f.held != nil {
+		f.ctx.schedule(f.held, f.finish)
+		f.held = nil
+	} else {
+		f.active--
+	}
+	f.cond.Broadcast()
+	f.lock.Unlock()
+	f.done()
+}
+
+func (f *flowControl) reject(pkt *Packet) {
+	err := newError(ErrTooManyRequests)
+	if pkt.Flag&FlagStream != 0 {
+		if s := f.ctx.acceptedStream(pkt.Seq); s != nil {
+			f.ctx.endStream(s, err)
+		}
+	} else if pkt.Flag&FlagWaitResponse != 0 {
+		f.ctx.endRequest(pkt.Seq)
+		f.ctx.sendError(pkt.Code, pkt.Seq, err)
+	}
+	pkt.Release()
+	f.done()
+}
+
+// done returns the credit of a handled request, grants are batched by half
+// of MaxConcurrent.
+func (f *flowControl) done() {
+	f.lock.Lock()
+	f.returned++
+	n := f.returned
+	if n*2 < f.opts.MaxConcurrent || f.closed {
+		f.lock.Unlock()
+		return
+	}
+	f.returned = 0
+	f.lock.Unlock()
+	f.ctx.sendCredit(n)
+}
+
+func (f *flowControl) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	if f.held != nil {
+		f.active++
+		f.ctx.schedule(f.held, f.finish)
+		f.held = nil
+	}
+	f.cond.Broadcast()
+}
+
+func (ctx *Context) sendCredit(n int) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(n))
+	return ctx.sendPacket(0, CodeCredit, 0, payload)
+}
+
+// credits are the requests we may send to the peer. Requests are unlimited
+// until the peer grants credits, but still counted. A grant of 0 removes the
+// limit.
+type credits struct {
+	lock    sync.Mutex
+	enabled bool
+	n       int
+	// wait is closed when credits are added
+	wait chan bool
+}
+
+func newCredits() *credits {
+	return &credits{wait: make(chan bool)}
+}
+
+func (c *credits) add(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if n == 0 {
+		c.enabled = false
+		c.n = 0
+	} else {
+		// requests sent before the first grant are counted by the peer, n is
+		// negative until they are returned
+		c.enabled = true
+		c.n += n
+	}
+	close(c.wait)
+	c.wait = make(chan bool)
+}
+
+// refund gives back a credit acquired for a request not sent.
+func (c *credits) refund() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.n++
+	close(c.wait)
+	c.wait = make(chan bool)
+}
+
+// reset removes the limit, e.g. when disconnected.
+func (c *credits) reset() {
+	c.add(0)
+}
+
+// acquire waits for a credit until timeout or cancel.
+func (c *credits) acquire(timeout <-chan time.Time, cancel <-chan bool) error {
+	for {
+		c.lock.Lock()
+		if !c.enabled || c.n > 0 {
+			c.n--
+			c.lock.Unlock()
+			return nil
+		}
+		wait := c.wait
+		c.lock.Unlock()
+		select {
+		case <-wait:
+		case <-timeout:
+			return newError(ErrTimeOut)
+		case <-cancel:
+			return newError(ErrCanceled)
+		}
+	}
+}
+
+// NumCredits returns the requests the peer still accepts, -1 if it does not
+// limit them.
+func (ctx *Context) NumCredits() int {
+	c := ctx.credits
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.enabled {
+		return -1
+	}
+	if c.n < 0 {
+		// requests sent before the grant are not returned yet
+		return 0
+	}
+	return c.n
+}
+
+func (ctx *Context) emitCredit(pkt *Packet) {
+	if len(pkt.Payload) != 4 {
+		ctx.debug("Bad credit packet", pkt.Payload)
+		return
+	}
+	ctx.credits.add(int(binary.BigEndian.Uint32(pkt.Payload)))
+}
@@ -0,0 +1,238 @@
+package flyrpc
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dialRaw(t *testing.T, addr string) *TcpProtocol {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	return NewTcpProtocol(conn, false)
+}
+
+func creditOf(pkt *Packet) int {
+	return int(binary.BigEndian.Uint32(pkt.Payload))
+}
+
+func TestFlowControl(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Flow:       &FlowOpts{MaxConcurrent: 2, Policy: LimitReject},
+	})
+	release := make(chan bool)
+	server.OnMessage("block", func(in []byte) []byte {
+		<-release
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15691")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	// a peer ignoring credits is rejected
+	p := dialRaw(t, "127.0.0.1:15691")
+	pkt, err := p.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeCredit, pkt.Code)
+	assert.Equal(t, 2, creditOf(pkt))
+	for seq := TSeq(1); seq <= 3; seq++ {
+		assert.NoError(t, p.SendPacket(&Packet{Flag: FlagWaitResponse, Code: "block", Seq: seq, Payload: []byte("1")}))
+	}
+	pkt, err = p.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, TSeq(3), pkt.Seq)
+	assert.Equal(t, ErrTooManyRequests, pkt.Code)
+	release <- true
+	release <- true
+	replies, credits := 0, 0
+	for replies < 2 || credits < 3 {
+		pkt, err = p.ReadPacket()
+		assert.NoError(t, err)
+		if pkt.Code == CodeCredit {
+			credits += creditOf(pkt)
+		} else {
+			assert.Equal(t, "", pkt.Code)
+			replies++
+		}
+	}
+	p.Close()
+
+	// a client waits for credits
+	client := makeClient(t, "127.0.0.1:15691")
+	for client.NumCredits() != 2 {
+		<-time.After(time.Millisecond)
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.GetReply("block", []byte("1"))
+			assert.NoError(t, err)
+		}()
+	}
+	<-time.After(10 * time.Millisecond)
+	assert.Equal(t, 0, client.NumCredits())
+	assert.Equal(t, 2, client.NumPending())
+	for i := 0; i < 3; i++ {
+		release <- true
+	}
+	wg.Wait()
+	server.Close()
+}
+
+func TestFlowPolicies(t *testing.T) {
+	addrs := map[LimitPolicy]string{
+		LimitQueue:       "127.0.0.1:15692",
+		LimitStopReading: "127.0.0.1:15693",
+	}
+	for policy, addr := range addrs {
+		server := NewServer(&ServerOpts{
+			Serializer: JSON,
+			Flow:       &FlowOpts{MaxConcurrent: 1, QueueSize: 1, Policy: policy},
+		})
+		lock := sync.Mutex{}
+		active, maxActive := 0, 0
+		server.OnMessage("slow", func(in []byte) []byte {
+			lock.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			lock.Unlock()
+			<-time.After(5 * time.Millisecond)
+			lock.Lock()
+			active--
+			lock.Unlock()
+			return in
+		})
+		go func() {
+			err := server.Listen("tcp", addr)
+			assert.Nil(t, err)
+		}()
+		<-time.After(10 * time.Millisecond)
+
+		p := dialRaw(t, addr)
+		for seq := TSeq(1); seq <= 4; seq++ {
+			assert.NoError(t, p.SendPacket(&Packet{Flag: FlagWaitResponse, Code: "slow", Seq: seq, Payload: []byte("1")}))
+		}
+		for replies := 0; replies < 4; {
+			pkt, err := p.ReadPacket()
+			assert.NoError(t, err)
+			if pkt.Code != CodeCredit {
+				assert.Equal(t, "", pkt.Code)
+				replies++
+			}
+		}
+		lock.Lock()
+		assert.Equal(t, 1, maxActive)
+		lock.Unlock()
+		p.Close()
+		server.Close()
+	}
+}
+
+func TestFlowCallPeer(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Flow:       &FlowOpts{MaxConcurrent: 1, Policy: LimitStopReading},
+	})
+	server.OnMessage("ask", func(ctx *Context, in string) string {
+		name, err := ctx.GetReply("name", in)
+		assert.NoError(t, err)
+		return string(name)
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15694")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	// a peer ignoring credits, the reply to the handler follows the request
+	// over the limit
+	p := dialRaw(t, "127.0.0.1:15694")
+	for seq := TSeq(1); seq <= 2; seq++ {
+		assert.NoError(t, p.SendPacket(&Packet{Flag: FlagWaitResponse, Code: "ask", Seq: seq, Payload: []byte(`"a"`)}))
+	}
+	timer := time.AfterFunc(time.Second, func() {
+		p.Close()
+	})
+	for replies := 0; replies < 2; {
+		pkt, err := p.ReadPacket()
+		if !assert.NoError(t, err) {
+			break
+		}
+		switch {
+		case pkt.Code == CodeCredit:
+		case pkt.Code == "name":
+			assert.NoError(t, p.SendPacket(&Packet{Flag: FlagResponse, Seq: pkt.Seq, Payload: []byte(`"b"`)}))
+		default:
+			assert.Equal(t, "", pkt.Code)
+			assert.Equal(t, `"b"`, string(pkt.Payload))
+			replies++
+		}
+	}
+	timer.Stop()
+	p.Close()
+	server.Close()
+}
+
+func TestFlowCreditsBeforeGrant(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:15695")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		server := NewTcpProtocol(conn, false)
+		// three calls before the grant of 2
+		seqs := make([]TSeq, 0, 3)
+		for len(seqs) < 3 {
+			pkt, err := server.ReadPacket()
+			assert.NoError(t, err)
+			seqs = append(seqs, pkt.Seq)
+		}
+		credit := make([]byte, 4)
+		binary.BigEndian.PutUint32(credit, 2)
+		server.SendPacket(&Packet{Code: CodeCredit, Payload: credit})
+		// the fourth call waits for the credits of the first ones
+		<-time.After(50 * time.Millisecond)
+		for _, seq := range seqs {
+			server.SendPacket(&Packet{Flag: FlagResponse, Seq: seq, Payload: []byte{}})
+		}
+		binary.BigEndian.PutUint32(credit, 3)
+		server.SendPacket(&Packet{Code: CodeCredit, Payload: credit})
+		pkt, err := server.ReadPacket()
+		assert.NoError(t, err)
+		server.SendPacket(&Packet{Flag: FlagResponse, Seq: pkt.Seq, Payload: []byte{}})
+	}()
+
+	client := makeClient(t, "127.0.0.1:15695")
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.GetReply("early", []byte{})
+			assert.NoError(t, err)
+		}()
+	}
+	// granted, still over the limit
+	for client.NumCredits() != 0 {
+		<-time.After(time.Millisecond)
+	}
+	start := time.Now()
+	_, err = client.GetReply("late", []byte{})
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+	wg.Wait()
+	assert.Equal(t, 1, client.NumCredits())
+	client.Close()
+}
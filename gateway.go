@@ -0,0 +1,579 @@
+package flyrpc
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GatewayOpts configures a Gateway.
+type GatewayOpts struct {
+	// Network to dial backends, default "tcp"
+	Network string
+	// Backends are addresses of servers listening with ServerOpts.Multiplex
+	Backends []string
+	// Selector pins new end-users to a backend, default RoundRobinSelector
+	Selector BackendSelector
+	// ClientKey returns the key of an end-user for the Selector, e.g. its IP.
+	// Default is the clientId.
+	ClientKey func(conn net.Conn) string
+	// PingInterval between health checks, default 5 seconds
+	PingInterval time.Duration
+	// PingTimeout marks a silent backend as down, default 3 * PingInterval
+	PingTimeout time.Duration
+	// Migrate end-users of a down backend to another one instead of
+	// disconnecting them. Backends don't share sessions, the new one sees a
+	// CodeClientJoin.
+	Migrate bool
+	// MaxCodeLength of packets from end-users, default DefaultMaxCodeLength
+	MaxCodeLength int
+	// MaxPayloadLength of packets from end-users, default
+	// DefaultMaxPayloadLength. A bigger packet is not forwarded, the end-user
+	// gets ErrBuffTooLong and is disconnected. Keep it within the limits of
+	// the backends, they close the whole link otherwise.
+	MaxPayloadLength TLength
+}
+
+// Gateway is a frontend server. It accepts end-user connections, assigns each
+// of them a clientId and multiplexes them over one link per backend server.
+type Gateway struct {
+	opts               *GatewayOpts
+	listener           net.Listener
+	backends           []*GatewayBackend
+	clients            map[int]*gatewayClient
+	clientsLock        sync.RWMutex
+	nextClientId       int
+	connectHandlers    []func(int)
+	disconnectHandlers []func(int)
+	upHandlers         []func(*GatewayBackend)
+	downHandlers       []func(*GatewayBackend, error)
+	migrateHandlers    []func(clientId int, from, to *GatewayBackend)
+	closeChan          chan bool
+	closeOnce          sync.Once
+}
+
+// GatewayBackend is a multiplexed link to a backend server.
+type GatewayBackend struct {
+	Addr     string
+	gateway  *Gateway
+	lock     sync.RWMutex
+	protocol Protocol
+	alive    bool
+	lastSeen time.Time
+	downErr  error
+	clients  int
+	// pingSeq is the Seq of the last health check
+	pingSeq TSeq
+}
+
+// gatewayClient is an end-user connection.
+type gatewayClient struct {
+	id         int
+	key        string
+	remoteAddr string
+	protocol   Protocol
+	backend    *GatewayBackend
+	closed     bool
+}
+
+func NewGateway(opts *GatewayOpts) *Gateway {
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if err := checkLimits(opts.MaxCodeLength); err != nil {
+		panic(err)
+	}
+	if opts.Selector == nil {
+		opts.Selector = RoundRobinSelector()
+	}
+	if opts.PingInterval == 0 {
+		opts.PingInterval = 5 * time.Second
+	}
+	if opts.PingTimeout == 0 {
+		opts.PingTimeout = 3 * opts.PingInterval
+	}
+	g := &Gateway{
+		opts:               opts,
+		backends:           make([]*GatewayBackend, 0, len(opts.Backends)),
+		clients:            make(map[int]*gatewayClient),
+		connectHandlers:    make([]func(int), 0),
+		disconnectHandlers: make([]func(int), 0),
+		closeChan:          make(chan bool),
+	}
+	for _, addr := range opts.Backends {
+		g.backends = append(g.backends, &GatewayBackend{Addr: addr, gateway: g})
+	}
+	return g
+}
+
+// OnConnect is called with the clientId of every accepted end-user.
+func (g *Gateway) OnConnect(handler func(int)) {
+	g.connectHandlers = append(g.connectHandlers, handler)
+}
+
+// OnDisconnect is called with the clientId of every closed end-user.
+func (g *Gateway) OnDisconnect(handler func(int)) {
+	g.disconnectHandlers = append(g.disconnectHandlers, handler)
+}
+
+// OnBackendUp is called when a backend is connected or reconnected.
+func (g *Gateway) OnBackendUp(handler func(*GatewayBackend)) {
+	g.upHandlers = append(g.upHandlers, handler)
+}
+
+// OnBackendDown is called when a backend is lost, on error or health check.
+func (g *Gateway) OnBackendDown(handler func(*GatewayBackend, error)) {
+	g.downHandlers = append(g.downHandlers, handler)
+}
+
+// OnMigrate is called when an end-user is moved from a down backend.
+func (g *Gateway) OnMigrate(handler func(clientId int, from, to *GatewayBackend)) {
+	g.migrateHandlers = append(g.migrateHandlers, handler)
+}
+
+// Backends returns every configured backend, alive or not.
+func (g *Gateway) Backends() []*GatewayBackend {
+	return g.backends
+}
+
+// NumClients returns the count of connected end-users.
+func (g *Gateway) NumClients() int {
+	g.clientsLock.RLock()
+	defer g.clientsLock.RUnlock()
+	return len(g.clients)
+}
+
+// Kick closes the connection of an end-user.
+func (g *Gateway) Kick(clientId int) {
+	c := g.getClient(clientId)
+	if c != nil {
+		g.removeClient(c, true)
+	}
+}
+
+// Listen dials the backends then accepts end-users on addr. Backends which
+// cannot be dialed are retried on every health check.
+func (g *Gateway) Listen(network, addr string) error {
+	if err := g.connectBackends(); err != nil {
+		return err
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		g.Close()
+		return err
+	}
+	g.listener = listener
+	go g.healthCheck()
+	g.handleConnections()
+	return nil
+}
+
+// Close stops accepting end-users and closes every connection. Backends are
+// not reported down and their end-users are not migrated.
+func (g *Gateway) Close() error {
+	var err error
+	g.closeOnce.Do(func() {
+		close(g.closeChan)
+		if g.listener != nil {
+			err = g.listener.Close()
+		}
+		g.clientsLock.RLock()
+		clients := make([]*gatewayClient, 0, len(g.clients))
+		for _, c := range g.clients {
+			clients = append(clients, c)
+		}
+		g.clientsLock.RUnlock()
+		for _, c := range clients {
+			g.removeClient(c, true)
+		}
+		g.closeBackends()
+	})
+	return err
+}
+
+func (g *Gateway) closing() bool {
+	select {
+	case <-g.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *Gateway) connectBackends() error {
+	if len(g.backends) == 0 {
+		return newError("gateway require backends")
+	}
+	var err error
+	numAlive := 0
+	for _, b := range g.backends {
+		if err = b.connect(); err != nil {
+			log.Println("Backend", b.Addr, "dial error", err)
+		} else {
+			numAlive++
+		}
+	}
+	if numAlive == 0 {
+		return err
+	}
+	return nil
+}
+
+func (g *Gateway) closeBackends() {
+	for _, b := range g.backends {
+		b.close(nil)
+	}
+}
+
+// healthCheck pings alive backends and redials down ones.
+func (g *Gateway) healthCheck() {
+	ticker := time.NewTicker(g.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.closeChan:
+			return
+		case <-ticker.C:
+		}
+		for _, b := range g.backends {
+			if !b.Alive() {
+				if err := b.connect(); err == nil {
+					log.Println("Backend", b.Addr, "reconnected")
+				}
+				continue
+			}
+			if time.Since(b.LastSeen()) > g.opts.PingTimeout {
+				b.close(newError(ErrTimeOut))
+				continue
+			}
+			b.ping()
+		}
+	}
+}
+
+func (g *Gateway) handleConnections() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			log.Println("Accept error", err)
+			break
+		}
+		g.addClient(conn)
+	}
+}
+
+// selectBackend pins an end-user to an alive backend, it returns nil if none.
+func (g *Gateway) selectBackend(c *gatewayClient) *GatewayBackend {
+	b := g.opts.Selector.Select(c.key, g.backends)
+	if b == nil || !b.Alive() {
+		return nil
+	}
+	return b
+}
+
+func (g *Gateway) addClient(conn net.Conn) {
+	g.clientsLock.Lock()
+	g.nextClientId++
+	protocol := NewTcpProtocol(conn, false)
+	protocol.setLimits(g.opts.MaxCodeLength, g.opts.MaxPayloadLength)
+	c := &gatewayClient{
+		id:         g.nextClientId,
+		remoteAddr: conn.RemoteAddr().String(),
+		protocol:   protocol,
+	}
+	g.clientsLock.Unlock()
+	if g.opts.ClientKey != nil {
+		c.key = g.opts.ClientKey(conn)
+	} else {
+		c.key = strconv.Itoa(c.id)
+	}
+
+	b := g.selectBackend(c)
+	if b == nil {
+		log.Println("No backend alive, reject", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	g.clientsLock.Lock()
+	g.pin(c, b)
+	g.clients[c.id] = c
+	g.clientsLock.Unlock()
+
+	if err := b.join(c.id, c.remoteAddr); err != nil {
+		log.Println("Join error", b.Addr, err)
+		g.removeClient(c, false)
+		return
+	}
+	for _, handler := range g.connectHandlers {
+		go handler(c.id)
+	}
+	go g.handleClientPackets(c)
+}
+
+func (g *Gateway) getClient(clientId int) *gatewayClient {
+	g.clientsLock.RLock()
+	defer g.clientsLock.RUnlock()
+	return g.clients[clientId]
+}
+
+func (g *Gateway) getBackend(c *gatewayClient) *GatewayBackend {
+	g.clientsLock.RLock()
+	defer g.clientsLock.RUnlock()
+	return c.backend
+}
+
+// pin assigns an end-user to a backend, under clientsLock so that the leave
+// of removeClient or migrateClient always follows.
+func (g *Gateway) pin(c *gatewayClient, b *GatewayBackend) {
+	c.backend = b
+	b.lock.Lock()
+	b.clients++
+	b.lock.Unlock()
+}
+
+// removeClient closes an end-user once. notifyBackend sends CodeClientLeave
+// to the pinned backend.
+func (g *Gateway) removeClient(c *gatewayClient, notifyBackend bool) {
+	g.clientsLock.Lock()
+	if c.closed {
+		g.clientsLock.Unlock()
+		return
+	}
+	c.closed = true
+	delete(g.clients, c.id)
+	b := c.backend
+	g.clientsLock.Unlock()
+
+	c.protocol.Close()
+	b.leave(c.id, notifyBackend)
+	for _, handler := range g.disconnectHandlers {
+		go handler(c.id)
+	}
+}
+
+// migrateClient moves an end-user of a down backend, it returns false if
+// no other backend is alive.
+func (g *Gateway) migrateClient(c *gatewayClient, from *GatewayBackend) bool {
+	to := g.selectBackend(c)
+	if to == nil {
+		return false
+	}
+	g.clientsLock.Lock()
+	if c.closed || c.backend != from {
+		// removeClient or another failover left already
+		g.clientsLock.Unlock()
+		return true
+	}
+	g.pin(c, to)
+	g.clientsLock.Unlock()
+	from.leave(c.id, false)
+	if err := to.join(c.id, c.remoteAddr); err != nil {
+		return false
+	}
+	for _, handler := range g.migrateHandlers {
+		go handler(c.id, from, to)
+	}
+	return true
+}
+
+func (g *Gateway) handleClientPackets(c *gatewayClient) {
+	for {
+		pkt, err := c.protocol.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Close on error", err)
+			}
+			g.removeClient(c, true)
+			break
+		}
+		if pkt.Code == CodePing && pkt.Flag&FlagResponse == 0 {
+			// the gateway is the peer of the end-user
+			replyPing(c.protocol, pkt)
+			pkt.Release()
+			continue
+		}
+		if isControlCode(pkt.Code) && pkt.Code != CodeCredit && pkt.Code != CodeSerializer && pkt.Code != CodeCancel && pkt.Flag&FlagResponse == 0 {
+			// end-users must not fake control packets
+			pkt.Release()
+			continue
+		}
+		pkt.ClientId = c.id
+		b := g.getBackend(c)
+		if err := b.sendPacket(pkt); err != nil {
+			log.Println("Forward error", b.Addr, err)
+		}
+		pkt.Release()
+	}
+}
+
+// Alive reports whether the link to the backend is up.
+func (b *GatewayBackend) Alive() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.alive
+}
+
+// NumClients returns the count of end-users pinned to the backend.
+func (b *GatewayBackend) NumClients() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.clients
+}
+
+// LastSeen returns when the backend sent the last packet.
+func (b *GatewayBackend) LastSeen() time.Time {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.lastSeen
+}
+
+func (b *GatewayBackend) connect() error {
+	conn, err := net.Dial(b.gateway.opts.Network, b.Addr)
+	if err != nil {
+		return err
+	}
+	protocol := NewTcpProtocol(conn, true)
+	b.lock.Lock()
+	b.protocol = protocol
+	b.alive = true
+	b.lastSeen = time.Now()
+	b.downErr = nil
+	b.lock.Unlock()
+	for _, handler := range b.gateway.upHandlers {
+		go handler(b)
+	}
+	go b.handlePackets(protocol)
+	return nil
+}
+
+// close marks the backend down and closes the link, err is the reason.
+func (b *GatewayBackend) close(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.alive {
+		return
+	}
+	b.alive = false
+	b.downErr = err
+	b.protocol.Close()
+}
+
+func (b *GatewayBackend) sendPacket(pkt *Packet) error {
+	b.lock.RLock()
+	protocol := b.protocol
+	alive := b.alive
+	b.lock.RUnlock()
+	if !alive {
+		return newError(ErrWriterClosed)
+	}
+	return protocol.SendPacket(pkt)
+}
+
+// ping sends a health check, the pong is its response of the same Seq.
+func (b *GatewayBackend) ping() {
+	b.lock.Lock()
+	b.pingSeq++
+	seq := b.pingSeq
+	b.lock.Unlock()
+	b.sendPacket(&Packet{
+		Flag:    FlagWaitResponse,
+		Code:    CodePing,
+		Seq:     seq,
+		Payload: []byte{},
+	})
+}
+
+// join tells the backend about an end-user pinned to it.
+func (b *GatewayBackend) join(clientId int, remoteAddr string) error {
+	return b.sendPacket(&Packet{
+		ClientId: clientId,
+		Code:     CodeClientJoin,
+		Payload:  []byte(remoteAddr),
+	})
+}
+
+// leave unpins an end-user, notify tells the backend.
+func (b *GatewayBackend) leave(clientId int, notify bool) {
+	b.lock.Lock()
+	b.clients--
+	b.lock.Unlock()
+	if notify {
+		b.sendPacket(&Packet{
+			ClientId: clientId,
+			Code:     CodeClientLeave,
+			Payload:  []byte{},
+		})
+	}
+}
+
+func (b *GatewayBackend) handlePackets(protocol Protocol) {
+	g := b.gateway
+	for {
+		pkt, err := protocol.ReadPacket()
+		if err != nil {
+			b.lock.Lock()
+			if b.alive {
+				b.alive = false
+				b.downErr = err
+				protocol.Close()
+			}
+			err = b.downErr
+			b.lock.Unlock()
+			if g.closing() {
+				break
+			}
+			if err != nil && err != io.EOF {
+				log.Println("Backend", b.Addr, "down on error", err)
+			}
+			for _, handler := range g.downHandlers {
+				go handler(b, err)
+			}
+			b.failover()
+			break
+		}
+		b.lock.Lock()
+		b.lastSeen = time.Now()
+		pong := pkt.ClientId == 0 && pkt.Flag&FlagResponse != 0 && pkt.Seq == b.pingSeq
+		b.lock.Unlock()
+		if pong {
+			pkt.Release()
+			continue
+		}
+		c := g.getClient(pkt.ClientId)
+		if c == nil {
+			pkt.Release()
+			continue
+		}
+		if pkt.Code == CodeClientLeave && pkt.Flag&FlagResponse == 0 {
+			// kicked by backend
+			g.removeClient(c, false)
+			continue
+		}
+		if err := c.protocol.SendPacket(pkt); err != nil {
+			log.Println("Reply error", c.id, err)
+		}
+		pkt.Release()
+	}
+}
+
+// failover migrates or disconnects every end-user pinned to a down backend.
+func (b *GatewayBackend) failover() {
+	g := b.gateway
+	g.clientsLock.RLock()
+	clients := make([]*gatewayClient, 0)
+	for _, c := range g.clients {
+		if c.backend == b {
+			clients = append(clients, c)
+		}
+	}
+	g.clientsLock.RUnlock()
+	for _, c := range clients {
+		if g.opts.Migrate && g.migrateClient(c, b) {
+			continue
+		}
+		g.removeClient(c, false)
+	}
+}
@@ -0,0 +1,136 @@
+package flyrpc
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// BackendSelector pins a new end-user of a Gateway to a backend. key is
+// the end-user key, see GatewayOpts.ClientKey. It must skip down backends and
+// return nil if none is alive.
+type BackendSelector interface {
+	Select(key string, backends []*GatewayBackend) *GatewayBackend
+}
+
+type roundRobinSelector struct {
+	next int
+	lock sync.Mutex
+}
+
+// RoundRobinSelector pins end-users to alive backends in turn.
+func RoundRobinSelector() BackendSelector {
+	return &roundRobinSelector{}
+}
+
+func (s *roundRobinSelector) Select(key string, backends []*GatewayBackend) *GatewayBackend {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := 0; i < len(backends); i++ {
+		b := backends[s.next%len(backends)]
+		s.next++
+		if b.Alive() {
+			return b
+		}
+	}
+	return nil
+}
+
+type leastConnectionsSelector struct{}
+
+// LeastConnectionsSelector pins end-users to the alive backend with the
+// fewest end-users.
+func LeastConnectionsSelector() BackendSelector {
+	return leastConnectionsSelector{}
+}
+
+func (leastConnectionsSelector) Select(key string, backends []*GatewayBackend) *GatewayBackend {
+	var selected *GatewayBackend
+	min := 0
+	for _, b := range backends {
+		if !b.Alive() {
+			continue
+		}
+		if n := b.NumClients(); selected == nil || n < min {
+			selected = b
+			min = n
+		}
+	}
+	return selected
+}
+
+type hashSelector struct {
+	replicas int
+	lock     sync.Mutex
+	addrs    []string
+	ring     []uint32
+	owners   map[uint32]int
+}
+
+// ConsistentHashSelector pins end-users by their key on a hash ring, so the
+// same key goes to the same backend while it is alive. Each backend is
+// placed replicas times on the ring, default 100.
+func ConsistentHashSelector(replicas int) BackendSelector {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	return &hashSelector{replicas: replicas}
+}
+
+func (s *hashSelector) Select(key string, backends []*GatewayBackend) *GatewayBackend {
+	if len(backends) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	s.build(backends)
+	ring, owners := s.ring, s.owners
+	s.lock.Unlock()
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i] >= h })
+	for i := 0; i < len(ring); i++ {
+		b := backends[owners[ring[(start+i)%len(ring)]]]
+		if b.Alive() {
+			return b
+		}
+	}
+	return nil
+}
+
+// build the ring when the backends changed.
+func (s *hashSelector) build(backends []*GatewayBackend) {
+	if len(s.addrs) == len(backends) {
+		same := true
+		for i, b := range backends {
+			if s.addrs[i] != b.Addr {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	s.addrs = make([]string, len(backends))
+	s.ring = make([]uint32, 0, len(backends)*s.replicas)
+	s.owners = make(map[uint32]int)
+	for i, b := range backends {
+		s.addrs[i] = b.Addr
+		for r := 0; r < s.replicas; r++ {
+			h := crc32.ChecksumIEEE([]byte(b.Addr + "#" + strconv.Itoa(r)))
+			if _, ok := s.owners[h]; ok {
+				continue
+			}
+			s.owners[h] = i
+			s.ring = append(s.ring, h)
+		}
+	}
+	sort.Sort(uint32Slice(s.ring))
+}
+
+type uint32Slice []uint32
+
+func (p uint32Slice) Len() int           { return len(p) }
+func (p uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
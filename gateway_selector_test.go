@@ -0,0 +1,67 @@
+package flyrpc
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeBackends(n int) []*GatewayBackend {
+	backends := make([]*GatewayBackend, n)
+	for i := range backends {
+		backends[i] = &GatewayBackend{Addr: "10.0.0." + strconv.Itoa(i), alive: true}
+	}
+	return backends
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	backends := makeBackends(3)
+	s := RoundRobinSelector()
+	assert.Equal(t, backends[0], s.Select("", backends))
+	assert.Equal(t, backends[1], s.Select("", backends))
+	assert.Equal(t, backends[2], s.Select("", backends))
+	assert.Equal(t, backends[0], s.Select("", backends))
+	backends[1].alive = false
+	assert.Equal(t, backends[2], s.Select("", backends))
+	for _, b := range backends {
+		b.alive = false
+	}
+	assert.Nil(t, s.Select("", backends))
+}
+
+func TestLeastConnectionsSelector(t *testing.T) {
+	backends := makeBackends(3)
+	backends[0].clients = 3
+	backends[1].clients = 1
+	backends[2].clients = 2
+	s := LeastConnectionsSelector()
+	assert.Equal(t, backends[1], s.Select("", backends))
+	backends[1].alive = false
+	assert.Equal(t, backends[2], s.Select("", backends))
+}
+
+func TestConsistentHashSelector(t *testing.T) {
+	backends := makeBackends(4)
+	s := ConsistentHashSelector(0)
+	pinned := make(map[string]*GatewayBackend)
+	used := make(map[*GatewayBackend]bool)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		pinned[key] = s.Select(key, backends)
+		used[pinned[key]] = true
+	}
+	assert.Equal(t, 4, len(used))
+
+	// only keys of the down backend move
+	down := backends[2]
+	down.alive = false
+	for key, b := range pinned {
+		selected := s.Select(key, backends)
+		if b == down {
+			assert.NotEqual(t, down, selected)
+		} else {
+			assert.Equal(t, b, selected)
+		}
+	}
+}
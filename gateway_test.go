@@ -0,0 +1,259 @@
+package flyrpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func acceptBackend(t *testing.T, addr string) chan *TcpProtocol {
+	listener, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	c := make(chan *TcpProtocol, 1)
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		listener.Close()
+		c <- NewTcpProtocol(conn, true)
+	}()
+	return c
+}
+
+func TestGatewayForward(t *testing.T) {
+	backendChan := acceptBackend(t, "127.0.0.1:15601")
+	gateway := NewGateway(&GatewayOpts{
+		Backends: []string{"127.0.0.1:15601"},
+	})
+	go func() {
+		err := gateway.Listen("tcp", "127.0.0.1:15602")
+		assert.NoError(t, err)
+	}()
+	backend := <-backendChan
+	<-time.After(10 * time.Millisecond)
+
+	client := makeClient(t, "127.0.0.1:15602")
+	pkt, err := backend.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeClientJoin, pkt.Code)
+	clientId := pkt.ClientId
+	assert.NotEqual(t, 0, clientId)
+	assert.Equal(t, 1, gateway.NumClients())
+
+	// answered by the gateway, not forwarded
+	assert.NoError(t, client.Ping(16, time.Second))
+
+	go func() {
+		pkt, err := backend.ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, clientId, pkt.ClientId)
+		assert.Equal(t, "hello", pkt.Code)
+		backend.SendPacket(&Packet{
+			ClientId: pkt.ClientId,
+			Flag:     FlagResponse,
+			Seq:      pkt.Seq,
+			Payload:  append([]byte("name:"), pkt.Payload...),
+		})
+	}()
+	bytes, err := client.GetReply("hello", "world")
+	assert.NoError(t, err)
+	assert.Equal(t, "name:world", string(bytes))
+
+	client.Close()
+	pkt, err = backend.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeClientLeave, pkt.Code)
+	assert.Equal(t, clientId, pkt.ClientId)
+	assert.Equal(t, 0, gateway.NumClients())
+	gateway.Close()
+}
+
+func TestGatewayLimits(t *testing.T) {
+	backendChan := acceptBackend(t, "127.0.0.1:15605")
+	gateway := NewGateway(&GatewayOpts{
+		Backends:         []string{"127.0.0.1:15605"},
+		MaxPayloadLength: 10,
+	})
+	go func() {
+		err := gateway.Listen("tcp", "127.0.0.1:15606")
+		assert.NoError(t, err)
+	}()
+	backend := <-backendChan
+	<-time.After(10 * time.Millisecond)
+
+	client := makeClient(t, "127.0.0.1:15606")
+	pkt, err := backend.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeClientJoin, pkt.Code)
+	clientId := pkt.ClientId
+
+	_, err = client.GetReply("echo", make([]byte, 11))
+	assert.Error(t, err)
+	assert.Equal(t, ErrBuffTooLong, err.Error())
+
+	// the packet is not forwarded, the end-user leaves
+	pkt, err = backend.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeClientLeave, pkt.Code)
+	assert.Equal(t, clientId, pkt.ClientId)
+	gateway.Close()
+}
+
+func TestGatewayBackendKick(t *testing.T) {
+	backendChan := acceptBackend(t, "127.0.0.1:15603")
+	gateway := NewGateway(&GatewayOpts{
+		Backends: []string{"127.0.0.1:15603"},
+	})
+	disconnected := make(chan int, 1)
+	gateway.OnDisconnect(func(clientId int) {
+		disconnected <- clientId
+	})
+	go func() {
+		err := gateway.Listen("tcp", "127.0.0.1:15604")
+		assert.NoError(t, err)
+	}()
+	backend := <-backendChan
+	<-time.After(10 * time.Millisecond)
+
+	makeClient(t, "127.0.0.1:15604")
+	pkt, err := backend.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeClientJoin, pkt.Code)
+
+	backend.SendPacket(&Packet{
+		ClientId: pkt.ClientId,
+		Code:     CodeClientLeave,
+	})
+	select {
+	case clientId := <-disconnected:
+		assert.Equal(t, pkt.ClientId, clientId)
+	case <-time.After(time.Second):
+		t.Fatal("client not kicked")
+	}
+	gateway.Close()
+}
+
+func TestGatewayFailover(t *testing.T) {
+	servers := make([]*Server, 2)
+	for i, addr := range []string{"127.0.0.1:15621", "127.0.0.1:15622"} {
+		server := NewServer(&ServerOpts{
+			Serializer: JSON,
+			Multiplex:  true,
+		})
+		name := addr
+		server.OnMessage("where", func() string {
+			return name
+		})
+		go func() {
+			err := server.Listen("tcp", name)
+			assert.Nil(t, err)
+		}()
+		servers[i] = server
+	}
+	<-time.After(10 * time.Millisecond)
+
+	gateway := NewGateway(&GatewayOpts{
+		Backends:     []string{"127.0.0.1:15621", "127.0.0.1:15622"},
+		Selector:     LeastConnectionsSelector(),
+		PingInterval: 20 * time.Millisecond,
+		Migrate:      true,
+	})
+	down := make(chan string, 2)
+	gateway.OnBackendDown(func(b *GatewayBackend, err error) {
+		down <- b.Addr
+	})
+	migrated := make(chan *GatewayBackend, 1)
+	gateway.OnMigrate(func(clientId int, from, to *GatewayBackend) {
+		migrated <- to
+	})
+	go func() {
+		err := gateway.Listen("tcp", "127.0.0.1:15623")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	client := makeClient(t, "127.0.0.1:15623")
+	first, err := client.GetReply("where", nil)
+	assert.NoError(t, err)
+
+	// stop the pinned backend
+	var other string
+	for i, addr := range []string{"127.0.0.1:15621", "127.0.0.1:15622"} {
+		if addr == string(first) {
+			servers[i].Close()
+		} else {
+			other = addr
+		}
+	}
+	assert.Equal(t, string(first), <-down)
+	to := <-migrated
+	assert.Equal(t, other, to.Addr)
+	assert.Equal(t, 1, to.NumClients())
+
+	second, err := client.GetReply("where", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, other, string(second))
+
+	// the client is counted once
+	<-time.After(10 * time.Millisecond)
+	for _, b := range gateway.Backends() {
+		if b.Addr == string(first) {
+			assert.Equal(t, 0, b.NumClients())
+		}
+	}
+	client.Close()
+	<-time.After(10 * time.Millisecond)
+	assert.Equal(t, 0, to.NumClients())
+
+	// a normal shutdown neither reports backends down nor migrates
+	gateway.Close()
+	assert.NoError(t, gateway.Close())
+	<-time.After(10 * time.Millisecond)
+	select {
+	case addr := <-down:
+		t.Fatal("reported down on close", addr)
+	case <-migrated:
+		t.Fatal("migrated on close")
+	default:
+	}
+	for _, server := range servers {
+		server.Close()
+	}
+}
+
+func TestGatewayHealthCheck(t *testing.T) {
+	// a backend that never answers
+	backendChan := acceptBackend(t, "127.0.0.1:15624")
+	gateway := NewGateway(&GatewayOpts{
+		Backends:     []string{"127.0.0.1:15624"},
+		PingInterval: 10 * time.Millisecond,
+		PingTimeout:  30 * time.Millisecond,
+	})
+	down := make(chan error, 1)
+	gateway.OnBackendDown(func(b *GatewayBackend, err error) {
+		down <- err
+	})
+	go func() {
+		err := gateway.Listen("tcp", "127.0.0.1:15625")
+		assert.NoError(t, err)
+	}()
+	backend := <-backendChan
+	go func() {
+		for {
+			pkt, err := backend.ReadPacket()
+			if err != nil {
+				break
+			}
+			assert.Equal(t, CodePing, pkt.Code)
+		}
+	}()
+	select {
+	case err := <-down:
+		assert.Equal(t, ErrTimeOut, err.Error())
+	case <-time.After(time.Second):
+		t.Fatal("backend not down")
+	}
+	assert.False(t, gateway.Backends()[0].Alive())
+	gateway.Close()
+}
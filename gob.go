@@ -0,0 +1,22 @@
+package flyrpc
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// Gob serializes with encoding/gob, for Go peers only. Every message carries
+// its own type description, as packets are decoded independently.
+var Gob Serializer = NewSerializer(gobMarshal, gobUnmarshal)
+
+func gobMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobUnmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,220 @@
+package flyrpc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientPicker returns a connection for every call, e.g. *Pool or
+// *ServiceClient.
+type ClientPicker interface {
+	PickClient() (*Client, error)
+}
+
+// HedgeOpts configures a HedgedClient.
+type HedgeOpts struct {
+	// Percentile of recent latencies of a code waited before hedging,
+	// default 0.95
+	Percentile float64
+	// Delay before hedging while a code has less than MinSamples latencies,
+	// default 50ms
+	Delay time.Duration
+	// MinSamples of latencies to use the Percentile, default 20
+	MinSamples int
+	// MaxHedges are extra calls sent at most, default 1
+	MaxHedges int
+}
+
+// HedgedClient sends an idempotent call again on another connection when the
+// first one is slower than usual. The first reply wins, the other calls are
+// canceled with CodeCancel, see Canceled. Only codes declared with
+// DeclareIdempotent are hedged, others are sent once.
+type HedgedClient struct {
+	picker    ClientPicker
+	opts      *HedgeOpts
+	lock      sync.Mutex
+	latencies map[string]*latencyWindow
+	numHedged int
+}
+
+var _ Caller = &HedgedClient{}
+
+type hedgeResult struct {
+	bytes  []byte
+	err    error
+	client *Client
+}
+
+// latencyWindow keeps the recent latencies of a code.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+const latencyWindowSize = 100
+
+func NewHedgedClient(picker ClientPicker, opts *HedgeOpts) *HedgedClient {
+	if opts == nil {
+		opts = &HedgeOpts{}
+	}
+	if opts.Percentile <= 0 || opts.Percentile > 1 {
+		opts.Percentile = 0.95
+	}
+	if opts.Delay == 0 {
+		opts.Delay = 50 * time.Millisecond
+	}
+	if opts.MinSamples <= 0 {
+		opts.MinSamples = 20
+	}
+	if opts.MaxHedges <= 0 {
+		opts.MaxHedges = 1
+	}
+	return &HedgedClient{
+		picker:    picker,
+		opts:      opts,
+		latencies: make(map[string]*latencyWindow),
+	}
+}
+
+// NumHedged returns the count of extra calls sent.
+func (h *HedgedClient) NumHedged() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.numHedged
+}
+
+// Delay returns how long a call of code waits before hedging.
+func (h *HedgedClient) Delay(code string) time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	w := h.latencies[code]
+	if w == nil || len(w.samples) < h.opts.MinSamples {
+		return h.opts.Delay
+	}
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Sort(durationSlice(sorted))
+	return sorted[int(float64(len(sorted)-1)*h.opts.Percentile)]
+}
+
+func (h *HedgedClient) observe(code string, latency time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	w := h.latencies[code]
+	if w == nil {
+		w = &latencyWindow{samples: make([]time.Duration, 0, latencyWindowSize)}
+		h.latencies[code] = w
+	}
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, latency)
+	} else {
+		w.samples[w.next] = latency
+		w.next = (w.next + 1) % latencyWindowSize
+	}
+}
+
+// pickOther returns a connection not used yet, or nil.
+func (h *HedgedClient) pickOther(used []*Client) *Client {
+	for i := 0; i < 2*len(used)+1; i++ {
+		c, err := h.picker.PickClient()
+		if err != nil {
+			return nil
+		}
+		isUsed := false
+		for _, u := range used {
+			if u == c {
+				isUsed = true
+				break
+			}
+		}
+		if !isUsed {
+			return c
+		}
+	}
+	return nil
+}
+
+func (h *HedgedClient) SendMessage(code string, message Message, opts ...CallOption) error {
+	c, err := h.picker.PickClient()
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(code, message, opts...)
+}
+
+func (h *HedgedClient) GetReply(code string, message Message, opts ...CallOption) ([]byte, error) {
+	r := h.getReply(code, message, opts)
+	return r.bytes, r.err
+}
+
+// getReply returns the first reply and the client which got it.
+func (h *HedgedClient) getReply(code string, message Message, opts []CallOption) hedgeResult {
+	first, err := h.picker.PickClient()
+	if err != nil {
+		return hedgeResult{err: err}
+	}
+	if !IsIdempotent(code) {
+		bytes, err := first.GetReply(code, message, opts...)
+		return hedgeResult{bytes, err, first}
+	}
+	cancel := make(chan bool)
+	// cancel the calls still running on the other connections
+	defer close(cancel)
+	results := make(chan hedgeResult, 1+h.opts.MaxHedges)
+	call := func(c *Client) {
+		bytes, err := c.GetReplyCancel(code, message, cancel, opts...)
+		results <- hedgeResult{bytes, err, c}
+	}
+
+	start := time.Now()
+	delay := h.Delay(code)
+	used := []*Client{first}
+	pending := 1
+	go call(first)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				h.observe(code, time.Since(start))
+				return r
+			}
+			if pending == 0 {
+				return r
+			}
+		case <-timer.C:
+			if len(used) > h.opts.MaxHedges {
+				continue
+			}
+			if c := h.pickOther(used); c != nil {
+				used = append(used, c)
+				pending++
+				h.lock.Lock()
+				h.numHedged++
+				h.lock.Unlock()
+				go call(c)
+			}
+			timer.Reset(delay)
+		}
+	}
+}
+
+func (h *HedgedClient) Call(code string, message Message, reply Message, opts ...CallOption) error {
+	r := h.getReply(code, message, opts)
+	if r.err != nil {
+		return r.err
+	}
+	if reply != nil {
+		return r.client.Serializer().Unmarshal(r.bytes, reply)
+	}
+	return nil
+}
+
+type durationSlice []time.Duration
+
+func (p durationSlice) Len() int           { return len(p) }
+func (p durationSlice) Less(i, j int) bool { return p[i] < p[j] }
+func (p durationSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
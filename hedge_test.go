@@ -0,0 +1,139 @@
+package flyrpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedgedClient(t *testing.T) {
+	addrs := []string{"127.0.0.1:15661", "127.0.0.1:15662"}
+	servers := make([]*Server, len(addrs))
+	for i, addr := range addrs {
+		server := NewServer(&ServerOpts{
+			Serializer: JSON,
+		})
+		delay := time.Duration(i) * 300 * time.Millisecond
+		handler := func() *TestUser {
+			<-time.After(delay)
+			return &TestUser{Id: int32(i)}
+		}
+		server.OnMessage("hedge.read", handler)
+		server.OnMessage("hedge.write", handler)
+		name := addr
+		go func() {
+			err := server.Listen("tcp", name)
+			assert.Nil(t, err)
+		}()
+		servers[i] = server
+	}
+	<-time.After(10 * time.Millisecond)
+
+	service, err := DialService("hedge", &ServiceOpts{
+		Resolver:        StaticResolver(addrs...),
+		RefreshInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	DeclareIdempotent("hedge.read")
+	client := NewHedgedClient(service, &HedgeOpts{
+		Delay: 20 * time.Millisecond,
+	})
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		u := &TestUser{}
+		assert.NoError(t, client.Call("hedge.read", nil, u))
+		assert.Equal(t, int32(0), u.Id)
+		assert.True(t, time.Since(start) < 200*time.Millisecond)
+	}
+	hedged := client.NumHedged()
+	assert.True(t, hedged > 0)
+
+	// not idempotent, never hedged
+	slow := false
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		assert.NoError(t, client.Call("hedge.write", nil, nil))
+		if time.Since(start) >= 300*time.Millisecond {
+			slow = true
+		}
+	}
+	assert.True(t, slow)
+	assert.Equal(t, hedged, client.NumHedged())
+
+	service.Close()
+	for _, server := range servers {
+		server.Close()
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	client := NewHedgedClient(nil, &HedgeOpts{
+		Delay:      time.Second,
+		MinSamples: 10,
+		Percentile: 0.9,
+	})
+	for i := 1; i <= 10; i++ {
+		assert.Equal(t, time.Second, client.Delay("x"))
+		client.observe("x", time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 9*time.Millisecond, client.Delay("x"))
+	assert.Equal(t, time.Second, client.Delay("y"))
+}
+
+func TestHedgeCancel(t *testing.T) {
+	addrs := []string{"127.0.0.1:15663", "127.0.0.1:15664"}
+	servers := make([]*Server, len(addrs))
+	canceled := make(chan int, 4)
+	for i, addr := range addrs {
+		server := NewServer(&ServerOpts{
+			Serializer: JSON,
+		})
+		id := i
+		delay := time.Duration(i) * 300 * time.Millisecond
+		server.OnMessage("hedge.cancel", func(done Canceled) *TestUser {
+			select {
+			case <-done:
+				canceled <- id
+			case <-time.After(delay):
+			}
+			return &TestUser{Id: int32(id)}
+		})
+		go func() {
+			err := server.Listen("tcp", addr)
+			assert.Nil(t, err)
+		}()
+		servers[i] = server
+	}
+	<-time.After(10 * time.Millisecond)
+
+	service, err := DialService("hedge", &ServiceOpts{
+		Resolver:        StaticResolver(addrs...),
+		RefreshInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	DeclareIdempotent("hedge.cancel")
+	client := NewHedgedClient(service, &HedgeOpts{
+		Delay: 20 * time.Millisecond,
+	})
+	for i := 0; i < 4; i++ {
+		u := &TestUser{}
+		assert.NoError(t, client.Call("hedge.cancel", nil, u))
+		assert.Equal(t, int32(0), u.Id)
+	}
+	assert.True(t, client.NumHedged() > 0)
+
+	// the slow server is told its call lost
+	select {
+	case id := <-canceled:
+		assert.Equal(t, 1, id)
+	case <-time.After(time.Second):
+		t.Fatal("not canceled")
+	}
+
+	service.Close()
+	for _, server := range servers {
+		server.Close()
+	}
+}
@@ -0,0 +1,38 @@
+package flyrpc
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Msgpack serializes with MessagePack. Fields are named by their msgpack
+// tag, or their json tag if none, so the JSON messages work as they are.
+var Msgpack Serializer = &msgpackSerializer{}
+
+type msgpackSerializer struct{}
+
+func (s *msgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return s.MarshalAppend(nil, v)
+}
+
+// MarshalAppend implements AppendSerializer.
+func (s *msgpackSerializer) MarshalAppend(buf []byte, v interface{}) ([]byte, error) {
+	w := bytes.NewBuffer(buf)
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(w)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (s *msgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+	dec.Reset(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,112 @@
+package flyrpc
+
+// errSerializerChanged fails a call encoded before a switch, it is encoded
+// again.
+const errSerializerChanged = "SERIALIZER_CHANGED"
+
+// serializerSwitch is the serializer a CodeSerializer call switches to.
+type serializerSwitch struct {
+	serializer Serializer
+	name       string
+}
+
+// UseSerializer switches the connection to the serializer registered as name,
+// on both peers. Call it before other calls, e.g. in ReconnectOpts.Handshake,
+// a reconnecting Client switches again on every new connection.
+//
+// Each peer sends no encoded packet while switching: the peer switches on
+// receipt then replies, we switch on the reply. Packets are decoded with the
+// serializer of the connection when they were received.
+func (ctx *Context) UseSerializer(name string) error {
+	serializer := GetSerializer(name)
+	if serializer == nil {
+		return newError(ErrUnknownSerializer)
+	}
+	ctx.switching.Lock()
+	defer ctx.switching.Unlock()
+	_, err := ctx.getReply(CodeSerializer, []byte(name), ctx.timeout, &callOpts{
+		priority: PriorityControl,
+		switchTo: &serializerSwitch{serializer, name},
+	})
+	return err
+}
+
+// AllowSerializers restricts the serializers the peer may switch to, others
+// are rejected with ErrUnknownSerializer. No names allows any registered one.
+func (ctx *Context) AllowSerializers(names ...string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.serializers = names
+}
+
+// allowsSerializer tells if the peer may switch to name.
+func (ctx *Context) allowsSerializer(name string) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if len(ctx.serializers) == 0 {
+		return true
+	}
+	for _, v := range ctx.serializers {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Serializer returns the serializer of the connection, the one of the Router
+// unless set or negotiated.
+func (ctx *Context) Serializer() Serializer {
+	serializer, _ := ctx.currentSerializer()
+	return serializer
+}
+
+// currentSerializer returns the serializer of the connection and its gen.
+func (ctx *Context) currentSerializer() (Serializer, int) {
+	ctx.lock.Lock()
+	serializer, gen := ctx.serializer, ctx.serializerGen
+	ctx.lock.Unlock()
+	if serializer == nil && ctx.Router != nil {
+		serializer = ctx.Router.getSerializer()
+	}
+	return serializer, gen
+}
+
+func (ctx *Context) setSerializer(serializer Serializer, name string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.serializer = serializer
+	ctx.serializerName = name
+	ctx.serializerGen++
+}
+
+// renegotiate tells a new connection the serializer negotiated before.
+func (ctx *Context) renegotiate() error {
+	ctx.lock.Lock()
+	name := ctx.serializerName
+	ctx.lock.Unlock()
+	if name == "" {
+		return nil
+	}
+	return ctx.UseSerializer(name)
+}
+
+// emitSerializer switches to the serializer asked by the peer. It runs in the
+// reading goroutine, before the following packets are dispatched.
+func (ctx *Context) emitSerializer(pkt *Packet) {
+	name, seq, flag := string(pkt.Payload), pkt.Seq, pkt.Flag
+	pkt.Release()
+	serializer := GetSerializer(name)
+	if serializer == nil || !ctx.allowsSerializer(name) {
+		ctx.sendError(CodeSerializer, seq, newError(ErrUnknownSerializer))
+		return
+	}
+	// the packets encoded before are sent before the reply, the peer
+	// switches on it
+	ctx.switching.Lock()
+	defer ctx.switching.Unlock()
+	ctx.setSerializer(serializer, name)
+	if flag&FlagWaitResponse != 0 {
+		ctx.sendPacketPriority(FlagResponse, "", seq, []byte{}, PriorityControl)
+	}
+}
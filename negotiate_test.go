@@ -0,0 +1,157 @@
+package flyrpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUseSerializer(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	contexts := make(chan *Context, 3)
+	server.OnConnect(func(ctx *Context) {
+		contexts <- ctx
+	})
+	server.OnMessage("whoami", func(ctx *Context, in *TestUser) *TestUser {
+		if ctx.Serializer() == Msgpack {
+			return &TestUser{Id: in.Id, Name: in.Name + ":msgpack"}
+		}
+		return &TestUser{Id: in.Id, Name: in.Name + ":json"}
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15721")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	jsonClient := makeClient(t, "127.0.0.1:15721")
+	<-contexts
+	client, err := DialReconnect("tcp", "127.0.0.1:15721", &ReconnectOpts{
+		Backoff: &Backoff{Min: 10 * time.Millisecond},
+	})
+	assert.NoError(t, err)
+	ctx := <-contexts
+	reconnected := make(chan bool, 1)
+	client.OnReconnect(func() {
+		reconnected <- true
+	})
+
+	err = client.UseSerializer("none")
+	assert.Equal(t, ErrUnknownSerializer, err.Error())
+	assert.NoError(t, client.UseSerializer("msgpack"))
+	assert.Equal(t, Msgpack, client.Serializer())
+	assert.Equal(t, Msgpack, ctx.Serializer())
+
+	// each connection talks its own serializer
+	u := &TestUser{}
+	assert.NoError(t, client.Call("whoami", &TestUser{Id: 1, Name: "a"}, u))
+	assert.Equal(t, TestUser{Id: 1, Name: "a:msgpack"}, *u)
+	assert.NoError(t, jsonClient.Call("whoami", &TestUser{Id: 2, Name: "b"}, u))
+	assert.Equal(t, TestUser{Id: 2, Name: "b:json"}, *u)
+	bytes, err := client.GetReply("whoami", &TestUser{Id: 3})
+	assert.NoError(t, err)
+	assert.NotNil(t, JSON.Unmarshal(bytes, u))
+	assert.Nil(t, Msgpack.Unmarshal(bytes, u))
+
+	// the peer rejects unknown names and keeps its serializer
+	_, err = client.getReply(CodeSerializer, []byte("none"), time.Second, &callOpts{})
+	assert.Equal(t, ErrUnknownSerializer, err.Error())
+	assert.NoError(t, client.Call("whoami", &TestUser{Id: 4, Name: "c"}, u))
+	assert.Equal(t, "c:msgpack", u.Name)
+
+	// negotiated again once reconnected
+	ctx.Close()
+	<-reconnected
+	ctx = <-contexts
+	assert.Equal(t, Msgpack, ctx.Serializer())
+	assert.NoError(t, client.Call("whoami", &TestUser{Id: 5, Name: "d"}, u))
+	assert.Equal(t, "d:msgpack", u.Name)
+
+	client.Close()
+	jsonClient.Close()
+	server.Close()
+}
+
+func TestAllowSerializers(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer:  JSON,
+		Serializers: []string{"msgpack"},
+	})
+	server.OnMessage("whoami", func(ctx *Context, in *TestUser) *TestUser {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15722")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	client := makeClient(t, "127.0.0.1:15722")
+	// registered but not allowed
+	err := client.UseSerializer("gob")
+	assert.Equal(t, ErrUnknownSerializer, err.Error())
+	assert.Equal(t, JSON, client.Serializer())
+	assert.NoError(t, client.UseSerializer("msgpack"))
+	u := &TestUser{}
+	assert.NoError(t, client.Call("whoami", &TestUser{Id: 1, Name: "a"}, u))
+	assert.Equal(t, "a", u.Name)
+	client.Close()
+	server.Close()
+}
+
+func TestUseSerializerPush(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	contexts := make(chan *Context, 1)
+	server.OnConnect(func(ctx *Context) {
+		contexts <- ctx
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15723")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	client := makeClient(t, "127.0.0.1:15723")
+	received := make(chan int32, 100000)
+	client.OnMessage("push", func(in *TestUser) {
+		received <- in.Id
+	})
+	ctx := <-contexts
+	stop := make(chan bool)
+	sent := make(chan int, 1)
+	go func() {
+		i := 0
+		for ; ; i++ {
+			select {
+			case <-stop:
+				sent <- i
+				return
+			default:
+			}
+			assert.NoError(t, ctx.SendMessage("push", &TestUser{Id: int32(i), Name: "push"}))
+		}
+	}()
+	<-received
+	// the pushes sent while switching are decoded too
+	assert.NoError(t, client.UseSerializer("msgpack"))
+	<-time.After(10 * time.Millisecond)
+	close(stop)
+	n := <-sent
+	count := 1
+	timeout := time.After(5 * time.Second)
+	for count < n {
+		select {
+		case <-received:
+			count++
+		case <-timeout:
+			t.Fatalf("%d of %d pushes lost", n-count, n)
+		}
+	}
+	client.Close()
+	server.Close()
+}
@@ -0,0 +1,95 @@
+package flyrpc
+
+// OrderKey returns the key of a received packet. Packets of the same key are
+// handled one after another in the order received, e.g. per game room.
+type OrderKey func(ctx *Context, pkt *Packet) string
+
+// Sequential orders every packet under the same key.
+func Sequential(ctx *Context, pkt *Packet) string {
+	return ""
+}
+
+// RouteOption configures a route added with AddRoute.
+type RouteOption func(*route)
+
+// WithOrder orders the packets of the route, it overrides the order of the
+// Context. Keys of a route do not wait for other routes.
+func WithOrder(key OrderKey) RouteOption {
+	return func(r *route) {
+		r.order = key
+	}
+}
+
+// SetOrder orders the handling of the packets received by the Context, nil
+// handles them concurrently. Streams are never ordered.
+func (ctx *Context) SetOrder(key OrderKey) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.order = key
+}
+
+// orderKey returns the key of pkt, false if it is not ordered.
+func (ctx *Context) orderKey(pkt *Packet) (string, bool) {
+	if pkt.Flag&FlagStream != 0 {
+		return "", false
+	}
+	if rt := ctx.Router.GetRoute(pkt.Code); rt != nil {
+		if order := rt.orderKey(); order != nil {
+			return pkt.Code + "\x00" + order(ctx, pkt), true
+		}
+	}
+	ctx.lock.Lock()
+	order := ctx.order
+	ctx.lock.Unlock()
+	if order == nil {
+		return "", false
+	}
+	return order(ctx, pkt), true
+}
+
+// schedule runs the handler of pkt then done, if any. Ordered packets are
+// queued on the worker of their key, it must be called in the order the
+// packets are received.
+func (ctx *Context) schedule(pkt *Packet, done func()) {
+	handle := func() {
+		ctx.emitPacket(pkt)
+		if done != nil {
+			done()
+		}
+	}
+	if key, ok := ctx.orderKey(pkt); ok {
+		ctx.enqueueInOrder(key, handle)
+		return
+	}
+	go handle()
+}
+
+// enqueueInOrder runs handle on the worker of key, started when the key has
+// none. Without flow control the queues are not bounded.
+func (ctx *Context) enqueueInOrder(key string, handle func()) {
+	ctx.lock.Lock()
+	queue, running := ctx.orderQueues[key]
+	ctx.orderQueues[key] = append(queue, handle)
+	ctx.lock.Unlock()
+	if !running {
+		go ctx.runInOrder(key)
+	}
+}
+
+// runInOrder handles the queue of key until it is empty.
+func (ctx *Context) runInOrder(key string) {
+	for {
+		ctx.lock.Lock()
+		queue := ctx.orderQueues[key]
+		if len(queue) == 0 {
+			delete(ctx.orderQueues, key)
+			ctx.lock.Unlock()
+			return
+		}
+		handle := queue[0]
+		queue[0] = nil
+		ctx.orderQueues[key] = queue[1:]
+		ctx.lock.Unlock()
+		handle()
+	}
+}
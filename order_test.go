@@ -0,0 +1,123 @@
+package flyrpc
+
+import (
+	"encoding/json"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrder(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Order:      Sequential,
+	})
+	lock := sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	received := make(map[string][]int32)
+	active, maxActive := 0, 0
+	handle := func(in *TestUser) {
+		lock.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		lock.Unlock()
+		// earlier packets are slower
+		<-time.After(time.Duration(20-in.Id) * time.Millisecond / 4)
+		lock.Lock()
+		active--
+		received[in.Name] = append(received[in.Name], in.Id)
+		lock.Unlock()
+		wg.Done()
+	}
+	server.OnMessage("plain", handle)
+	server.OnMessage("room", handle, WithOrder(func(ctx *Context, pkt *Packet) string {
+		u := &TestUser{}
+		json.Unmarshal(pkt.Payload, u)
+		return u.Name
+	}))
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15701")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15701")
+
+	expected := make([]int32, 20)
+	for i := range expected {
+		expected[i] = int32(i)
+	}
+
+	// ordered by the connection
+	wg.Add(20)
+	for i := int32(0); i < 20; i++ {
+		assert.NoError(t, client.SendMessage("plain", &TestUser{Id: i, Name: "plain"}))
+	}
+	wg.Wait()
+	assert.Equal(t, expected, received["plain"])
+	assert.Equal(t, 1, maxActive)
+
+	// ordered per room, rooms run concurrently
+	wg.Add(40)
+	for i := int32(0); i < 20; i++ {
+		assert.NoError(t, client.SendMessage("room", &TestUser{Id: i, Name: "a"}))
+		assert.NoError(t, client.SendMessage("room", &TestUser{Id: i, Name: "b"}))
+	}
+	wg.Wait()
+	assert.Equal(t, expected, received["a"])
+	assert.Equal(t, expected, received["b"])
+	assert.Equal(t, 2, maxActive)
+
+	server.Close()
+}
+
+func TestOrderWorkers(t *testing.T) {
+	addrs := map[string]*FlowOpts{
+		"127.0.0.1:15702": nil,
+		"127.0.0.1:15703": {MaxConcurrent: 300},
+	}
+	for addr, flow := range addrs {
+		server := NewServer(&ServerOpts{
+			Serializer: JSON,
+			Order:      Sequential,
+			Flow:       flow,
+		})
+		release := make(chan bool)
+		lock := sync.Mutex{}
+		received := make([]int, 0, 200)
+		wg := &sync.WaitGroup{}
+		server.OnMessage("block", func(in int) {
+			<-release
+			lock.Lock()
+			received = append(received, in)
+			lock.Unlock()
+			wg.Done()
+		})
+		go func() {
+			err := server.Listen("tcp", addr)
+			assert.Nil(t, err)
+		}()
+		<-time.After(10 * time.Millisecond)
+		client := makeClient(t, addr)
+		base := runtime.NumGoroutine()
+
+		// waiting packets are queued, not handled by a goroutine each
+		wg.Add(200)
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, client.SendMessage("block", i))
+		}
+		<-time.After(50 * time.Millisecond)
+		assert.True(t, runtime.NumGoroutine() < base+10)
+		close(release)
+		wg.Wait()
+		for i, v := range received {
+			assert.Equal(t, i, v)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,235 @@
+package flyrpc
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// PoolOpts configures a Pool.
+type PoolOpts struct {
+	// Size is the count of connections, default 4
+	Size int
+	// Serializer of every connection, default JSON
+	Serializer Serializer
+	// Backoff between dials of a broken connection, default 100ms to 30s
+	Backoff *Backoff
+	// MaxCodeLength of received packets, default DefaultMaxCodeLength
+	MaxCodeLength int
+	// MaxPayloadLength of received packets, default DefaultMaxPayloadLength.
+	// A bigger reply fails the call and closes the connection.
+	MaxPayloadLength TLength
+}
+
+// Pool maintains several connections to one server address and spreads
+// calls across them. Broken connections are replaced in the background.
+type Pool struct {
+	network string
+	address string
+	opts    *PoolOpts
+	router  Router
+	lock    sync.RWMutex
+	// interceptors of every connection
+	interceptors []Interceptor
+	clients      []*Client
+	next         int
+	closed       bool
+	closeChan    chan bool
+	serializer   Serializer
+}
+
+var _ Caller = &Pool{}
+
+// DialPool dials opts.Size connections to address.
+func DialPool(network, address string, opts *PoolOpts) (*Pool, error) {
+	if opts == nil {
+		opts = &PoolOpts{}
+	}
+	if opts.Size <= 0 {
+		opts.Size = 4
+	}
+	if opts.Serializer == nil {
+		opts.Serializer = JSON
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = &Backoff{Jitter: 0.2}
+	}
+	p := &Pool{
+		network:    network,
+		address:    address,
+		opts:       opts,
+		router:     NewRouter(opts.Serializer),
+		clients:    make([]*Client, opts.Size),
+		closeChan:  make(chan bool),
+		serializer: opts.Serializer,
+	}
+	for i := range p.clients {
+		c, err := p.dial(i)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.clients[i] = c
+	}
+	return p, nil
+}
+
+// dial connects the slot i, handlers are shared by every connection.
+func (p *Pool) dial(i int) (*Client, error) {
+	protocol, err := dialProtocol(p.network, p.address, p.opts.MaxCodeLength, p.opts.MaxPayloadLength)
+	if err != nil {
+		return nil, err
+	}
+	c := newClientWith(protocol, p.serializer, func(c *Client) {
+		c.Router = p.router
+		c.RemoteAddr = p.address
+		p.lock.RLock()
+		c.interceptors = p.interceptors
+		p.lock.RUnlock()
+	})
+	c.OnDisconnect(func(err error) {
+		p.replace(i, c)
+	})
+	return c, nil
+}
+
+// replace redials the slot i of a broken Client.
+func (p *Pool) replace(i int, broken *Client) {
+	p.lock.Lock()
+	if p.closed || p.clients[i] != broken {
+		p.lock.Unlock()
+		return
+	}
+	p.clients[i] = nil
+	p.lock.Unlock()
+	go func() {
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-p.closeChan:
+				return
+			case <-time.After(p.opts.Backoff.Duration(attempt)):
+			}
+			c, err := p.dial(i)
+			if err != nil {
+				continue
+			}
+			p.lock.Lock()
+			if p.closed {
+				p.lock.Unlock()
+				c.Close()
+				return
+			}
+			p.clients[i] = c
+			p.lock.Unlock()
+			log.Println("Pool replaced connection", p.address, i)
+			return
+		}
+	}()
+}
+
+// Get returns the next alive connection in turn.
+func (p *Pool) Get() (*Client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil, newError(ErrWriterClosed)
+	}
+	for i := 0; i < len(p.clients); i++ {
+		c := p.clients[p.next%len(p.clients)]
+		p.next++
+		if c != nil {
+			return c, nil
+		}
+	}
+	return nil, newError(ErrDisconnected)
+}
+
+// PickClient implements ClientPicker.
+func (p *Pool) PickClient() (*Client, error) {
+	return p.Get()
+}
+
+// NumAlive returns the count of connected connections.
+func (p *Pool) NumAlive() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	n := 0
+	for _, c := range p.clients {
+		if c != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// NumPending returns the count of calls waiting for a reply.
+func (p *Pool) NumPending() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	n := 0
+	for _, c := range p.clients {
+		if c != nil {
+			n += c.NumPending()
+		}
+	}
+	return n
+}
+
+// Use adds interceptors to the calls of every connection, see Context.Use.
+func (p *Pool) Use(interceptors ...Interceptor) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.interceptors = append(p.interceptors[:len(p.interceptors):len(p.interceptors)], interceptors...)
+	for _, c := range p.clients {
+		if c != nil {
+			c.Use(interceptors...)
+		}
+	}
+}
+
+// OnMessage handles messages sent by the server on any connection.
+func (p *Pool) OnMessage(code string, handler HandlerFunc, opts ...RouteOption) {
+	p.router.AddRoute(code, handler, opts...)
+}
+
+func (p *Pool) SendMessage(code string, message Message, opts ...CallOption) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(code, message, opts...)
+}
+
+func (p *Pool) GetReply(code string, message Message, opts ...CallOption) ([]byte, error) {
+	c, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	return c.GetReply(code, message, opts...)
+}
+
+func (p *Pool) Call(code string, message Message, reply Message, opts ...CallOption) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+	return c.Call(code, message, reply, opts...)
+}
+
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.closeChan)
+	clients := p.clients
+	p.lock.Unlock()
+	for _, c := range clients {
+		if c != nil {
+			c.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package flyrpc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	contexts := make(chan *Context, 10)
+	server.OnConnect(func(ctx *Context) {
+		contexts <- ctx
+	})
+	server.OnMessage("whoami", func(ctx *Context) (*TestUser, error) {
+		return &TestUser{Id: int32(ctx.ClientId)}, nil
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15641")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	pool, err := DialPool("tcp", "127.0.0.1:15641", &PoolOpts{
+		Size:    3,
+		Backoff: &Backoff{Min: 10 * time.Millisecond},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pool.NumAlive())
+	var ctx *Context
+	for i := 0; i < 3; i++ {
+		ctx = <-contexts
+	}
+
+	// calls are spread across connections
+	ids := make(map[int32]bool)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u := &TestUser{}
+			assert.NoError(t, pool.Call("whoami", nil, u))
+			lock.Lock()
+			ids[u.Id] = true
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, len(ids))
+
+	// a broken connection is replaced
+	ctx.Close()
+	ctx = <-contexts
+	<-time.After(10 * time.Millisecond)
+	assert.Equal(t, 3, pool.NumAlive())
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, pool.Call("whoami", nil, nil))
+	}
+
+	// server messages reach the shared routes
+	received := make(chan string, 1)
+	pool.OnMessage("notify", func(in string) {
+		received <- in
+	})
+	assert.NoError(t, ctx.SendMessage("notify", "hi"))
+	assert.Equal(t, "hi", <-received)
+
+	pool.Close()
+	_, err = pool.Get()
+	assert.Error(t, err)
+	server.Close()
+}
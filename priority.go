@@ -0,0 +1,193 @@
+package flyrpc
+
+import "sync"
+
+// Priority is the class of an outbound packet. A connection writes the
+// waiting packets of the highest class first, in order within a class.
+type Priority byte
+
+const (
+	// PriorityInteractive is the default, e.g. calls and replies
+	PriorityInteractive Priority = iota
+	// PriorityControl is used for control codes, e.g. CodePing
+	PriorityControl
+	// PriorityBulk is used for chunks, see Stream.Writer
+	PriorityBulk
+)
+
+// rank orders the classes, 0 is written first.
+func (p Priority) rank() int {
+	switch p {
+	case PriorityControl:
+		return 0
+	case PriorityBulk:
+		return 2
+	}
+	return 1
+}
+
+// CallOption configures a single SendMessage, GetReply or Call.
+type CallOption func(*callOpts)
+
+type callOpts struct {
+	priority Priority
+	cancel   <-chan bool
+	// gen of the serializer the payload is encoded with, 0 if raw
+	gen int
+	// switchTo is the serializer a CodeSerializer call switches to
+	switchTo *serializerSwitch
+}
+
+// WithPriority sends the packet with the priority.
+func WithPriority(priority Priority) CallOption {
+	return func(o *callOpts) {
+		o.priority = priority
+	}
+}
+
+func newCallOpts(opts []CallOption) *callOpts {
+	o := &callOpts{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+type writeRequest struct {
+	pkt  *Packet
+	done chan error
+}
+
+// writeQueue holds the packets waiting for the writer loop, the highest
+// priority is written first and in order within a priority.
+type writeQueue struct {
+	lock   *sync.Mutex
+	cond   *sync.Cond
+	queues [3][]*writeRequest
+	// writing while the writer loop or a sender owns the connection
+	writing bool
+	err     error
+}
+
+func newWriteQueue() writeQueue {
+	lock := &sync.Mutex{}
+	return writeQueue{lock: lock, cond: sync.NewCond(lock)}
+}
+
+func (q *writeQueue) push(req *writeRequest, priority Priority) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	rank := priority.rank()
+	q.queues[rank] = append(q.queues[rank], req)
+	q.cond.Signal()
+	return nil
+}
+
+// tryWrite owns the connection if it is idle, the caller writes its packet
+// directly then calls doneWrite.
+func (q *writeQueue) tryWrite() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.err != nil || q.writing || !q.empty() {
+		return false
+	}
+	q.writing = true
+	return true
+}
+
+func (q *writeQueue) doneWrite() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.writing = false
+	// wake the writer loop and the senders of Writer
+	q.cond.Broadcast()
+}
+
+// acquire waits until the connection is idle and owns it, the caller calls
+// doneWrite once written.
+func (q *writeQueue) acquire() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.err == nil && q.writing {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return q.err
+	}
+	q.writing = true
+	return nil
+}
+
+// wait blocks until packets can be written, it returns false once closed.
+func (q *writeQueue) wait() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.err == nil && (q.empty() || q.writing) {
+		q.cond.Wait()
+	}
+	return q.err == nil
+}
+
+// pop waits for packets and owns the connection, it returns up to
+// maxPackets of them, more than maxBytes only for a single packet. It
+// returns false once closed.
+func (q *writeQueue) pop(maxPackets int, maxBytes int) ([]*writeRequest, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.err == nil && (q.empty() || q.writing) {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return nil, false
+	}
+	q.writing = true
+	batch := make([]*writeRequest, 0, 8)
+	size := 0
+	for rank := range q.queues {
+		queue := q.queues[rank]
+		for len(queue) > 0 && len(batch) < maxPackets {
+			req := queue[0]
+			size += len(req.pkt.Payload)
+			if size > maxBytes && len(batch) > 0 {
+				break
+			}
+			queue[0] = nil
+			queue = queue[1:]
+			batch = append(batch, req)
+		}
+		q.queues[rank] = queue
+		if len(batch) >= maxPackets || size > maxBytes {
+			break
+		}
+	}
+	return batch, true
+}
+
+func (q *writeQueue) empty() bool {
+	for _, queue := range q.queues {
+		if len(queue) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// close fails the queued and later packets with err.
+func (q *writeQueue) close(err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.err != nil {
+		return
+	}
+	q.err = err
+	for rank, queue := range q.queues {
+		for _, req := range queue {
+			req.done <- err
+		}
+		q.queues[rank] = nil
+	}
+	q.cond.Broadcast()
+}
@@ -0,0 +1,83 @@
+package flyrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteQueue(t *testing.T) {
+	q := newWriteQueue()
+	push := func(priority Priority, length int) {
+		req := &writeRequest{pkt: &Packet{Priority: priority, Payload: make([]byte, length)}, done: make(chan error, 1)}
+		assert.NoError(t, q.push(req, priority))
+	}
+	priorities := func(batch []*writeRequest) []Priority {
+		ret := make([]Priority, len(batch))
+		for i, req := range batch {
+			ret[i] = req.pkt.Priority
+		}
+		return ret
+	}
+	push(PriorityBulk, 10)
+	push(PriorityInteractive, 10)
+	push(PriorityBulk, 10)
+	push(PriorityControl, 10)
+	batch, ok := q.pop(3, 1000)
+	assert.True(t, ok)
+	assert.Equal(t, []Priority{PriorityControl, PriorityInteractive, PriorityBulk}, priorities(batch))
+	// owned by the writer loop
+	assert.False(t, q.tryWrite())
+	q.doneWrite()
+	batch, ok = q.pop(3, 1000)
+	assert.True(t, ok)
+	assert.Equal(t, []Priority{PriorityBulk}, priorities(batch))
+	q.doneWrite()
+
+	// idle, a sender writes directly
+	assert.True(t, q.tryWrite())
+	q.doneWrite()
+
+	// bytes bound, a single big packet still goes
+	push(PriorityBulk, 2000)
+	push(PriorityBulk, 10)
+	assert.False(t, q.tryWrite())
+	batch, _ = q.pop(3, 1000)
+	assert.Equal(t, 1, len(batch))
+	q.doneWrite()
+	batch, _ = q.pop(3, 1000)
+	assert.Equal(t, 1, len(batch))
+	q.doneWrite()
+
+	// close fails the queued packets and wakes pop
+	req := &writeRequest{pkt: &Packet{}, done: make(chan error, 1)}
+	q.push(req, PriorityBulk)
+	q.close(newError(ErrWriterClosed))
+	assert.Equal(t, ErrWriterClosed, (<-req.done).Error())
+	_, ok = q.pop(3, 1000)
+	assert.False(t, ok)
+	assert.Error(t, q.push(req, PriorityBulk))
+}
+
+func TestCallPriority(t *testing.T) {
+	mp := NewMockProtocol()
+	ctx := NewContext(mp, NewRouter(JSON), 1, JSON)
+	assert.NoError(t, ctx.SendMessage("bulk", "x", WithPriority(PriorityBulk)))
+	pkt, _ := mp.ReadPacket()
+	assert.Equal(t, PriorityBulk, pkt.Priority)
+	assert.NoError(t, ctx.SendMessage("hello", "x"))
+	pkt, _ = mp.ReadPacket()
+	assert.Equal(t, PriorityInteractive, pkt.Priority)
+
+	go ctx.GetReply("bulk", "x", WithPriority(PriorityBulk))
+	pkt, _ = mp.ReadPacket()
+	assert.Equal(t, PriorityBulk, pkt.Priority)
+
+	s, err := ctx.OpenStream("upload", nil)
+	assert.NoError(t, err)
+	mp.ReadPacket()
+	w := s.Writer()
+	w.Write(make([]byte, ChunkSize))
+	pkt, _ = mp.ReadPacket()
+	assert.Equal(t, PriorityBulk, pkt.Priority)
+}
@@ -0,0 +1,44 @@
+package flyrpc
+
+import (
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// Protobuf serializes proto messages, either generated by the current
+// protobuf API or by the legacy github.com/golang/protobuf. Other values fail
+// with ErrNotProtoMessage.
+var Protobuf Serializer = &protobufSerializer{}
+
+type protobufSerializer struct{}
+
+func protoMessageOf(v interface{}) (proto.Message, error) {
+	switch m := v.(type) {
+	case proto.Message:
+		return m, nil
+	case protoadapt.MessageV1:
+		return protoadapt.MessageV2Of(m), nil
+	}
+	return nil, newFlyError(ErrNotProtoMessage, nil)
+}
+
+func (s *protobufSerializer) Marshal(v interface{}) ([]byte, error) {
+	return s.MarshalAppend(nil, v)
+}
+
+// MarshalAppend implements AppendSerializer.
+func (s *protobufSerializer) MarshalAppend(buf []byte, v interface{}) ([]byte, error) {
+	m, err := protoMessageOf(v)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{}.MarshalAppend(buf, m)
+}
+
+func (s *protobufSerializer) Unmarshal(data []byte, v interface{}) error {
+	m, err := protoMessageOf(v)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, m)
+}
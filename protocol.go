@@ -7,11 +7,43 @@ package flyrpc
 const (
 	FlagResponse     byte = 0x80
 	FlagWaitResponse byte = 0x40
+	FlagStream       byte = 0x20
+	FlagStreamEnd    byte = 0x10
 	FlagZipCode      byte = 0x08
 	FlagZipPayload   byte = 0x04
 	FlagLenPayload   byte = 0x03
 )
 
+// Control codes are reserved, a gateway tells its backends about
+// end-user connections with them. The payload of CodeClientJoin is the remote
+// address of the end-user. A backend may send CodeClientLeave to kick a client.
+// CodePing is echoed by any peer, for keepalive and health checks.
+// CodeCredit grants the peer more requests, see FlowOpts.
+// CodeSerializer switches the serializer of the connection, its payload is a
+// registered name, see UseSerializer.
+// CodeCancel gives up the call of its Seq, see Canceled.
+const (
+	CodeClientJoin  = "$join"
+	CodeClientLeave = "$leave"
+	CodePing        = "$ping"
+	CodeCredit      = "$credit"
+	CodeSerializer  = "$serializer"
+	CodeCancel      = "$cancel"
+)
+
+func isControlCode(code string) bool {
+	return len(code) > 0 && code[0] == '$'
+}
+
+func replyPing(protocol Protocol, pkt *Packet) error {
+	return protocol.SendPacket(&Packet{
+		ClientId: pkt.ClientId,
+		Flag:     FlagResponse,
+		Seq:      pkt.Seq,
+		Payload:  pkt.Payload,
+	})
+}
+
 type TSeq uint16
 type TLength uint64
 
@@ -28,8 +60,16 @@ type Packet struct {
 	Length  TLength
 	Code    string
 	Payload []byte
+	// Priority of an outbound packet, it is not sent
+	Priority Priority
+	// buf backs the Payload of a received packet, see Release
+	buf []byte
+	// serializer of the connection when received, see UseSerializer
+	serializer Serializer
 }
 
+// Protocol reads and sends packets. SendPacket must not keep the payload
+// once it returns, it may be reused.
 type Protocol interface {
 	ReadPacket() (*Packet, error)
 	SendPacket(*Packet) error
@@ -0,0 +1,123 @@
+package flyrpc
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is the address of a service instance.
+type Endpoint struct {
+	Addr string
+	// Weight for WeightedBalancer, 0 counts as 1
+	Weight int
+}
+
+// Resolver returns the endpoints of a service name. It is called again on
+// every ServiceOpts.RefreshInterval.
+type Resolver interface {
+	Resolve(service string) ([]Endpoint, error)
+}
+
+// ResolverFunc plugs a registry backend, e.g. etcd or consul, as a Resolver.
+type ResolverFunc func(service string) ([]Endpoint, error)
+
+func (f ResolverFunc) Resolve(service string) ([]Endpoint, error) {
+	return f(service)
+}
+
+type staticResolver []Endpoint
+
+// StaticResolver always returns addrs, whatever the service.
+func StaticResolver(addrs ...string) Resolver {
+	endpoints := make(staticResolver, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = Endpoint{Addr: addr}
+	}
+	return endpoints
+}
+
+func (r staticResolver) Resolve(service string) ([]Endpoint, error) {
+	return r, nil
+}
+
+type dnsResolver struct {
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSResolver looks up the SRV records of the service name, e.g.
+// "_flyrpc._tcp.example.com". SRV weights become endpoint weights.
+func DNSResolver() Resolver {
+	return &dnsResolver{lookupSRV: net.LookupSRV}
+}
+
+func (r *dnsResolver) Resolve(service string) ([]Endpoint, error) {
+	_, records, err := r.lookupSRV("", "", service)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]Endpoint, len(records))
+	for i, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		endpoints[i] = Endpoint{
+			Addr:   net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			Weight: int(srv.Weight),
+		}
+	}
+	return endpoints, nil
+}
+
+type fileResolver struct {
+	path      string
+	lock      sync.Mutex
+	modTime   time.Time
+	endpoints []Endpoint
+}
+
+// FileResolver reads endpoints from a file, one "addr [weight]" per line,
+// lines starting with # are ignored. The file is read again when modified.
+func FileResolver(path string) Resolver {
+	return &fileResolver{path: path}
+}
+
+func (r *fileResolver) Resolve(service string) ([]Endpoint, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.endpoints != nil && info.ModTime().Equal(r.modTime) {
+		return r.endpoints, nil
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	endpoints := make([]Endpoint, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ep := Endpoint{Addr: fields[0]}
+		if len(fields) > 1 {
+			if ep.Weight, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		endpoints = append(endpoints, ep)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	r.modTime = info.ModTime()
+	r.endpoints = endpoints
+	return endpoints, nil
+}
@@ -0,0 +1,60 @@
+package flyrpc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticResolver(t *testing.T) {
+	endpoints, err := StaticResolver("a:1", "b:2").Resolve("any")
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Addr: "a:1"}, {Addr: "b:2"}}, endpoints)
+}
+
+func TestDNSResolver(t *testing.T) {
+	r := &dnsResolver{lookupSRV: func(service, proto, name string) (string, []*net.SRV, error) {
+		assert.Equal(t, "_flyrpc._tcp.example.com", name)
+		return "", []*net.SRV{
+			{Target: "a.example.com.", Port: 1000, Weight: 3},
+			{Target: "b.example.com.", Port: 1001, Weight: 1},
+		}, nil
+	}}
+	endpoints, err := r.Resolve("_flyrpc._tcp.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{
+		{Addr: "a.example.com:1000", Weight: 3},
+		{Addr: "b.example.com:1001", Weight: 1},
+	}, endpoints)
+}
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flyrpc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "endpoints")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("# comment\na:1 2\n\nb:2\n"), 0644))
+
+	r := FileResolver(path)
+	endpoints, err := r.Resolve("any")
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Addr: "a:1", Weight: 2}, {Addr: "b:2"}}, endpoints)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("c:3\n"), 0644))
+	later := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(path, later, later))
+	endpoints, err = r.Resolve("any")
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Addr: "c:3"}}, endpoints)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("d:4 x\n"), 0644))
+	later = later.Add(time.Second)
+	assert.NoError(t, os.Chtimes(path, later, later))
+	_, err = r.Resolve("any")
+	assert.Error(t, err)
+}
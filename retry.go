@@ -0,0 +1,75 @@
+package flyrpc
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	idempotentCodes     = make(map[string]bool)
+	idempotentCodesLock sync.RWMutex
+)
+
+// DeclareIdempotent marks codes as safe to be sent more than once. Only
+// idempotent calls are retried.
+func DeclareIdempotent(codes ...string) {
+	idempotentCodesLock.Lock()
+	defer idempotentCodesLock.Unlock()
+	for _, code := range codes {
+		idempotentCodes[code] = true
+	}
+}
+
+// IsIdempotent reports whether code was declared with DeclareIdempotent.
+func IsIdempotent(code string) bool {
+	idempotentCodesLock.RLock()
+	defer idempotentCodesLock.RUnlock()
+	return idempotentCodes[code]
+}
+
+// RetryPolicy configures RetryInterceptor.
+type RetryPolicy struct {
+	// MaxAttempts including the first one, default 3
+	MaxAttempts int
+	// Backoff between attempts, default 100ms to 30s with 0.2 jitter
+	Backoff *Backoff
+	// RetryableErrors are error codes worth another attempt, default
+	// ErrTimeOut and ErrDisconnected
+	RetryableErrors []string
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	for _, code := range p.RetryableErrors {
+		if err.Error() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryInterceptor retries failed calls of idempotent codes.
+func RetryInterceptor(policy *RetryPolicy) Interceptor {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.Backoff == nil {
+		policy.Backoff = &Backoff{Jitter: 0.2}
+	}
+	if policy.RetryableErrors == nil {
+		policy.RetryableErrors = []string{ErrTimeOut, ErrDisconnected}
+	}
+	return func(ctx *Context, code string, payload []byte, invoke Invoker) ([]byte, error) {
+		reply, err := invoke(ctx, code, payload)
+		if err == nil || !IsIdempotent(code) {
+			return reply, err
+		}
+		for attempt := 1; attempt < policy.MaxAttempts && policy.retryable(err); attempt++ {
+			<-time.After(policy.Backoff.Duration(attempt - 1))
+			ctx.debug("Retry", code, attempt, err)
+			if reply, err = invoke(ctx, code, payload); err == nil {
+				break
+			}
+		}
+		return reply, err
+	}
+}
@@ -0,0 +1,150 @@
+package flyrpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryInterceptor(t *testing.T) {
+	protocol := NewMockDelayProtocol(time.Millisecond)
+	router := NewRouter(JSON)
+	context := NewContext(protocol, router, 0, JSON)
+	context.Use(RetryInterceptor(&RetryPolicy{
+		Backoff:         &Backoff{Min: time.Millisecond},
+		RetryableErrors: []string{"UNAVAILABLE"},
+	}))
+	calls := int32(0)
+	flaky := func() (string, error) {
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			return "", newError("UNAVAILABLE")
+		}
+		return "ok", nil
+	}
+	router.AddRoute("retry.flaky", flaky)
+	router.AddRoute("retry.unsafe", flaky)
+	downs := int32(0)
+	router.AddRoute("retry.down", func() error {
+		atomic.AddInt32(&downs, 1)
+		return newError("UNAVAILABLE")
+	})
+	DeclareIdempotent("retry.flaky", "retry.down")
+	go func() {
+		for {
+			pkt, err := protocol.ReadPacket()
+			context.emitPacket(pkt)
+			if err != nil {
+				break
+			}
+		}
+	}()
+
+	bytes, err := context.GetReply("retry.flaky", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(bytes))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// not idempotent
+	_, err = context.GetReply("retry.unsafe", nil)
+	assert.Error(t, err)
+	assert.Equal(t, "UNAVAILABLE", err.Error())
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	// attempts are limited
+	_, err = context.GetReply("retry.down", nil)
+	assert.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&downs))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(&BreakerOpts{
+		Threshold:   2,
+		OpenTimeout: 20 * time.Millisecond,
+	})
+	interceptor := breaker.Interceptor()
+	ctx := &Context{RemoteAddr: "a:1"}
+	other := &Context{RemoteAddr: "b:1"}
+	var result error
+	calls := 0
+	invoke := func(ctx *Context, code string, payload []byte) ([]byte, error) {
+		calls++
+		return nil, result
+	}
+
+	result = newError(ErrTimeOut)
+	for i := 0; i < 2; i++ {
+		_, err := interceptor(ctx, "x", nil, invoke)
+		assert.Equal(t, ErrTimeOut, err.Error())
+	}
+	assert.True(t, breaker.IsOpen("a:1"))
+	_, err := interceptor(ctx, "x", nil, invoke)
+	assert.Equal(t, ErrCircuitOpen, err.Error())
+	assert.Equal(t, 2, calls)
+
+	// other targets are not affected
+	_, err = interceptor(other, "x", nil, invoke)
+	assert.Equal(t, ErrTimeOut, err.Error())
+	assert.False(t, breaker.IsOpen("b:1"))
+
+	// a failed trial opens again
+	<-time.After(25 * time.Millisecond)
+	_, err = interceptor(ctx, "x", nil, invoke)
+	assert.Equal(t, ErrTimeOut, err.Error())
+	_, err = interceptor(ctx, "x", nil, invoke)
+	assert.Equal(t, ErrCircuitOpen, err.Error())
+
+	// a successful trial closes it
+	<-time.After(25 * time.Millisecond)
+	result = nil
+	_, err = interceptor(ctx, "x", nil, invoke)
+	assert.NoError(t, err)
+	assert.False(t, breaker.IsOpen("a:1"))
+}
+
+func TestUseWhileCalling(t *testing.T) {
+	protocol := NewMockDelayProtocol(time.Millisecond)
+	router := NewRouter(JSON)
+	context := NewContext(protocol, router, 0, JSON)
+	router.AddRoute("echo", func(in string) string {
+		return in
+	})
+	go func() {
+		for {
+			pkt, err := protocol.ReadPacket()
+			if err != nil {
+				break
+			}
+			context.emitPacket(pkt)
+		}
+	}()
+	intercepted := int32(0)
+	count := func(ctx *Context, code string, payload []byte, invoke Invoker) ([]byte, error) {
+		atomic.AddInt32(&intercepted, 1)
+		return invoke(ctx, code, payload)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				bytes, err := context.GetReply("echo", "a")
+				assert.NoError(t, err)
+				assert.Equal(t, "a", string(bytes))
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		context.Use(count)
+	}
+	wg.Wait()
+
+	atomic.StoreInt32(&intercepted, 0)
+	_, err := context.GetReply("echo", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&intercepted))
+}
@@ -2,10 +2,13 @@ package flyrpc
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"reflect"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Message must be explicit type, e.g. *User
@@ -17,37 +20,67 @@ import (
 // func(*Context, Message) Message
 // func(*Context, Message) error
 // func(*Context, Message) (Message, error)
+// func(*Context, *Stream) error
+// func(*Context, Message, *Stream) error
+// func(*Context, io.Reader) error
+// func(*Context, Message, io.Writer) error
 type HandlerFunc interface{}
 
 type Route interface {
 	emitPacket(*Context, *Packet) error
+	orderKey() OrderKey
 }
 
 type Router interface {
-	AddRoute(string, HandlerFunc)
+	AddRoute(string, HandlerFunc, ...RouteOption)
 	GetRoute(string) Route
+	// SetSerializer swaps the default serializer of all the routes, a
+	// Context negotiated with UseSerializer keeps its own one.
+	SetSerializer(Serializer)
 	emitPacket(*Context, *Packet) error
+	getSerializer() Serializer
 }
 
 type route struct {
 	serializer Serializer
-	handler    HandlerFunc
-	// rpcFunc     RpcFunc
-	// messageFunc MessageFunc
-	vHandler    reflect.Value
-	numIn       int
-	numOut      int
-	inTypes     []reflect.Type
-	outTypes    []reflect.Type
+	// router gives the default serializer at dispatch, nil for NewRoute
+	router *router
+	// pinned by WithSerializer, over the serializer of the connection
+	pinned   bool
+	handler  HandlerFunc
+	vHandler reflect.Value
+	// binders of the params, nil if fast
+	binders []binder
+	// fast calls common signatures without reflect
+	fast        fastCall
 	outErrIndex int
 	outType     reflect.Type
+	// encode the Message result
+	encode func(ctx *Context, out interface{}) ([]byte, bool, error)
+	// isStream if the handler takes a *Stream
+	isStream bool
+	order    OrderKey
+	// releasePacket unless the handler may keep the payload
+	releasePacket bool
+	// takesContext if the handler may read Context.Packet
+	takesContext bool
 }
 
+// binder returns the value of a handler param.
+type binder func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error)
+
+// fastCall runs a handler of a known signature, out is its result.
+type fastCall func(ctx *Context, pkt *Packet) (out interface{}, err error)
+
 var (
 	_err        error
 	typeError   = reflect.TypeOf(&_err).Elem()
 	typeContext = reflect.TypeOf(&Context{})
 	typePacket  = reflect.TypeOf(&Packet{})
+	typeStream  = reflect.TypeOf(&Stream{})
+	typeCancel  = reflect.TypeOf(Canceled(nil))
+	typeReader  = reflect.TypeOf((*io.Reader)(nil)).Elem()
+	typeWriter  = reflect.TypeOf((*io.Writer)(nil)).Elem()
 )
 
 func NewRoute(handlerFunc HandlerFunc, s Serializer) *route {
@@ -55,47 +88,248 @@ func NewRoute(handlerFunc HandlerFunc, s Serializer) *route {
 		panic("require serializer")
 	}
 	r := &route{
-		serializer:  s,
-		handler:     handlerFunc,
-		vHandler:    reflect.ValueOf(handlerFunc),
-		outErrIndex: -1,
+		serializer:    s,
+		handler:       handlerFunc,
+		vHandler:      reflect.ValueOf(handlerFunc),
+		outErrIndex:   -1,
+		releasePacket: true,
 	}
 	// FIXME better validate handler
 	if r.vHandler.Kind() != reflect.Func {
 		panic("handler must be func(...)...")
 	}
-	numIn := r.vHandler.Type().NumIn()
-	numOut := r.vHandler.Type().NumOut()
-	r.numIn = numIn
-	r.numOut = numOut
-	r.inTypes = make([]reflect.Type, numIn)
-	r.outTypes = make([]reflect.Type, numOut)
+	handlerType := r.vHandler.Type()
+	numIn := handlerType.NumIn()
+	numOut := handlerType.NumOut()
+	r.binders = make([]binder, numIn)
 	for i := 0; i < numIn; i++ {
-		r.inTypes[i] = r.vHandler.Type().In(i)
+		inType := handlerType.In(i)
+		if inType == typeStream || inType == typeReader || inType == typeWriter {
+			r.isStream = true
+		}
+		if inType == typeBytes || inType == typePacket {
+			r.releasePacket = false
+		}
+		if inType == typeContext {
+			// Context.Packet is shared by the handlers, it is never pooled
+			r.takesContext = true
+			r.releasePacket = false
+		}
+		r.binders[i] = r.binderOf(inType)
 	}
+	outTypes := make([]reflect.Type, numOut)
 	for i := 0; i < numOut; i++ {
-		r.outTypes[i] = r.vHandler.Type().Out(i)
+		outTypes[i] = handlerType.Out(i)
 	}
 	if numOut > 2 {
 		panic("Too much returns, handler must return (Message, error) or error")
 	}
 	if numOut == 2 {
-		if !r.outTypes[1].AssignableTo(typeError) {
+		if !outTypes[1].AssignableTo(typeError) {
 			panic("Handler should return (Message, error)")
 		}
 	}
 	if numOut > 0 {
-		if r.outTypes[numOut-1].AssignableTo(typeError) {
+		if outTypes[numOut-1].AssignableTo(typeError) {
 			r.outErrIndex = numOut - 1
 		}
-		if !r.outTypes[0].AssignableTo(typeError) {
-			r.outType = r.outTypes[0]
+		if !outTypes[0].AssignableTo(typeError) {
+			r.outType = outTypes[0]
 		}
 	}
+	r.encode = r.encoderOf(r.outType)
+	if !r.isStream {
+		r.fast = fastCallOf(handlerFunc)
+	}
 	return r
 }
 
-func (route *route) call(values []reflect.Value) (result []reflect.Value, err error) {
+func (route *route) binderOf(inType reflect.Type) binder {
+	switch inType {
+	case typeContext:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(ctx), nil
+		}
+	case typePacket:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(pkt), nil
+		}
+	case typeStream:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(stream), nil
+		}
+	case typeCancel:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(ctx.canceledOf(pkt.Seq)), nil
+		}
+	case typeReader:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(stream.Reader()), nil
+		}
+	case typeWriter:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(stream.Writer()), nil
+		}
+	case typeBytes:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(pkt.Payload), nil
+		}
+	case typeString:
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			return reflect.ValueOf(string(pkt.Payload)), nil
+		}
+	}
+	return route.decoderOf(inType)
+}
+
+// decoderOf binds the message param, a pointer, a value or an interface
+// registered with RegisterType.
+func (route *route) decoderOf(inType reflect.Type) binder {
+	switch {
+	case inType.Kind() == reflect.Ptr:
+		elem := inType.Elem()
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			v := reflect.New(elem)
+			if err := route.decodingSerializer(ctx, pkt).Unmarshal(pkt.Payload, v.Interface()); err != nil {
+				return v, &InvalidArgument{Message: err.Error()}
+			}
+			return v, ctx.validate(v.Interface())
+		}
+	case inType.Kind() == reflect.Interface:
+		if registeredTypes(inType) == nil {
+			if inType.NumMethod() > 0 {
+				panic("Interface param must be registered, e.g. RegisterType((*Shape)(nil), &Circle{})")
+			}
+			break
+		}
+		// resolved when decoded, the types registered later are used too
+		return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+			v, err := decodeInterface(inType, pkt.Payload, route.decodingSerializer(ctx, pkt))
+			if err != nil {
+				return v, &InvalidArgument{Message: err.Error()}
+			}
+			return v, ctx.validate(v.Interface())
+		}
+	}
+	// decoded as it is, e.g. a struct, a map, []User, int
+	return func(ctx *Context, pkt *Packet, stream *Stream) (reflect.Value, error) {
+		v := reflect.New(inType)
+		if err := route.decodingSerializer(ctx, pkt).Unmarshal(pkt.Payload, v.Interface()); err != nil {
+			return v.Elem(), &InvalidArgument{Message: err.Error()}
+		}
+		return v.Elem(), ctx.validate(v.Interface())
+	}
+}
+
+func (route *route) encoderOf(outType reflect.Type) func(*Context, interface{}) ([]byte, bool, error) {
+	switch outType {
+	case nil:
+		return nil
+	case typeBytes:
+		return func(ctx *Context, out interface{}) ([]byte, bool, error) {
+			return out.([]byte), false, nil
+		}
+	case typeString:
+		return func(ctx *Context, out interface{}) ([]byte, bool, error) {
+			return []byte(out.(string)), false, nil
+		}
+	}
+	return func(ctx *Context, out interface{}) ([]byte, bool, error) {
+		return messageToBuffer(out, route.serializerOf(ctx))
+	}
+}
+
+// serializerOf returns the serializer pinned by WithSerializer, or else the
+// one of the connection, the router's one is the fallback.
+func (route *route) serializerOf(ctx *Context) Serializer {
+	if route.pinned {
+		return route.serializer
+	}
+	if s := ctx.Serializer(); s != nil {
+		return s
+	}
+	if route.router != nil {
+		return route.router.getSerializer()
+	}
+	return route.serializer
+}
+
+// decodingSerializer returns the serializer pkt was received with, unless
+// pinned.
+func (route *route) decodingSerializer(ctx *Context, pkt *Packet) Serializer {
+	if !route.pinned && pkt.serializer != nil {
+		return pkt.serializer
+	}
+	return route.serializerOf(ctx)
+}
+
+// WithSerializer pins the serializer of the route, for both the message param
+// and the reply, whatever the connection uses.
+func WithSerializer(serializer Serializer) RouteOption {
+	return func(r *route) {
+		if serializer == nil {
+			panic("require serializer")
+		}
+		r.serializer = serializer
+		r.pinned = true
+	}
+}
+
+// fastCallOf returns nil if the signature of handler is not a known one.
+func fastCallOf(handler HandlerFunc) fastCall {
+	switch h := handler.(type) {
+	case func(*Context, []byte) ([]byte, error):
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return h(ctx, pkt.Payload)
+		}
+	case func(*Context, []byte) []byte:
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return h(ctx, pkt.Payload), nil
+		}
+	case func(*Context, []byte) error:
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return nil, h(ctx, pkt.Payload)
+		}
+	case func(*Context, []byte):
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			h(ctx, pkt.Payload)
+			return nil, nil
+		}
+	case func([]byte) ([]byte, error):
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return h(pkt.Payload)
+		}
+	case func([]byte) []byte:
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return h(pkt.Payload), nil
+		}
+	case func(*Context, *Packet) ([]byte, error):
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return h(ctx, pkt)
+		}
+	case func(*Context, *Packet) error:
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return nil, h(ctx, pkt)
+		}
+	case func(*Context) error:
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			return nil, h(ctx)
+		}
+	case func(*Context):
+		return func(ctx *Context, pkt *Packet) (interface{}, error) {
+			h(ctx)
+			return nil, nil
+		}
+	}
+	return nil
+}
+
+func (route *route) orderKey() OrderKey {
+	return route.order
+}
+
+// call runs the handler, a panic is returned as ErrHandlerPanic.
+func (route *route) call(ctx *Context, pkt *Packet, values []reflect.Value) (out interface{}, err error) {
 	defer func() {
 		r := recover()
 		if r != nil {
@@ -105,105 +339,132 @@ func (route *route) call(values []reflect.Value) (result []reflect.Value, err er
 			fmt.Printf("Error: %s\n%s", r, stack)
 		}
 	}()
-	result = route.vHandler.Call(values)
-	return
+	if route.fast != nil {
+		return route.fast(ctx, pkt)
+	}
+	result := route.vHandler.Call(values)
+	if route.outErrIndex >= 0 && !result[route.outErrIndex].IsNil() {
+		err = result[route.outErrIndex].Interface().(error)
+	}
+	if route.outType != nil {
+		out = result[0].Interface()
+	}
+	return out, err
 }
 
 func (route *route) emitPacket(ctx *Context, pkt *Packet) error {
-	values := make([]reflect.Value, route.numIn)
-	for i := 0; i < route.numIn; i++ {
-		inType := route.inTypes[i]
-		if inType == typeContext {
-			values[i] = reflect.ValueOf(ctx)
-		} else if inType == typePacket {
-			values[i] = reflect.ValueOf(pkt)
-		} else if inType == typeBytes {
-			values[i] = reflect.ValueOf(pkt.Payload)
-		} else if inType == typeString {
-			values[i] = reflect.ValueOf(string(pkt.Payload))
-		} else {
-			v := reflect.New(inType.Elem())
-			err := route.serializer.Unmarshal(pkt.Payload, v.Interface())
+	if route.releasePacket {
+		defer ctx.releasePacket(pkt)
+	} else if route.takesContext {
+		ctx.setPacket(pkt)
+	}
+	var stream *Stream
+	if route.isStream {
+		stream = ctx.acceptedStream(pkt.Seq)
+		if stream == nil {
+			return ctx.sendError(pkt.Code, pkt.Seq, newError(ErrUnknownSubType))
+		}
+		if route.pinned {
+			stream.serializer = route.serializer
+		}
+	}
+	var values []reflect.Value
+	if route.fast == nil {
+		values = make([]reflect.Value, len(route.binders))
+		for i, bind := range route.binders {
+			v, err := bind(ctx, pkt, stream)
 			if err != nil {
-				return err
+				if stream != nil {
+					return ctx.endStream(stream, err)
+				}
+				return ctx.sendError(pkt.Code, pkt.Seq, err)
 			}
 			values[i] = v
 		}
 	}
-	ret, err := route.call(values)
+	out, err := route.call(ctx, pkt, values)
+	if stream != nil {
+		return ctx.endStream(stream, err)
+	}
 	if err != nil {
 		return ctx.sendError(pkt.Code, pkt.Seq, err)
 	}
-	// retSize := len(ret)
-	// if retSize != route.numOut {
-	// 	panic("Error result size")
-	// }
-	if route.outErrIndex >= 0 {
-		ve := ret[route.outErrIndex]
-		if !ve.IsNil() {
-			err := ve.Interface().(error)
-			if err != nil {
-				return ctx.sendError(pkt.Code, pkt.Seq, err)
-			}
-		}
-	}
 	if pkt.Flag&FlagWaitResponse == 0 {
 		// not a RPC, no response
 		return nil
 	}
-	if route.outType != nil {
-		var bytes []byte
-		vout := ret[0].Interface()
-		// rpc return
-		if route.outType == typeBytes {
-			bytes = vout.([]byte)
-		} else if route.outType == typeString {
-			bytes = []byte(vout.(string))
-		} else {
-			bytes, err = route.serializer.Marshal(vout)
-			if err != nil {
-				return err
-			}
-		}
-		return ctx.sendPacket(
-			FlagResponse,
-			"", // pkt.Code,
-			pkt.Seq,
-			bytes)
-	}
-	// just return an empty ack message
-	return ctx.sendPacket(
-		FlagResponse,
-		"", // pkt.Code,
-		pkt.Seq,
-		[]byte{},
-	)
-	return nil
+	if route.encode == nil {
+		// just return an empty ack message
+		return ctx.sendPacket(FlagResponse, "", pkt.Seq, []byte{})
+	}
+	// rpc return, sent with the serializer it is encoded with, see
+	// UseSerializer
+	ctx.switching.RLock()
+	defer ctx.switching.RUnlock()
+	bytes, pooled, err := route.encode(ctx, out)
+	if err != nil {
+		return err
+	}
+	if pooled {
+		defer putBuffer(bytes)
+	}
+	return ctx.sendPacket(FlagResponse, "", pkt.Seq, bytes)
 }
 
 type router struct {
-	routes     map[string]Route
-	serializer Serializer
-	// routesLock sync.RWMutex
+	routes map[string]Route
+	// serializer is the default one, read by the routes at dispatch
+	serializer atomic.Value
+	// lock allows to add routes while serving
+	lock sync.RWMutex
+}
+
+// serializerValue boxes a Serializer, an atomic.Value stores a single type.
+type serializerValue struct {
+	Serializer
 }
 
 func NewRouter(serializer Serializer) Router {
-	return &router{routes: make(map[string]Route), serializer: serializer}
+	router := &router{routes: make(map[string]Route)}
+	router.serializer.Store(serializerValue{serializer})
+	return router
 }
 
-func (router *router) AddRoute(code string, h HandlerFunc) {
-	route := NewRoute(h, router.serializer)
+func (router *router) AddRoute(code string, h HandlerFunc, opts ...RouteOption) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	route := NewRoute(h, router.getSerializer())
+	route.router = router
+	for _, opt := range opts {
+		opt(route)
+	}
 	router.routes[code] = route
 }
 
 func (router *router) GetRoute(code string) Route {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
 	return router.routes[code]
 }
 
+// SetSerializer swaps the serializer of the routes, it is their fallback if
+// the Context has none.
+func (router *router) SetSerializer(serializer Serializer) {
+	if serializer == nil {
+		panic("require serializer")
+	}
+	router.serializer.Store(serializerValue{serializer})
+}
+
+func (router *router) getSerializer() Serializer {
+	return router.serializer.Load().(serializerValue).Serializer
+}
+
 func (router *router) emitPacket(ctx *Context, p *Packet) error {
 	rt := router.GetRoute(p.Code)
 	if rt == nil {
 		log.Println("Command", p.Code, "not found")
+		defer ctx.releasePacket(p)
 		return ctx.sendError(p.Code, p.Seq, newError(ErrNotFound))
 	}
 	return rt.emitPacket(ctx, p)
@@ -2,6 +2,8 @@ package flyrpc
 
 import (
 	"errors"
+	"io/ioutil"
+	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -110,3 +112,220 @@ func TestRouterPanic(t *testing.T) {
 	})
 	assert.Nil(t, err)
 }
+
+func TestRouteSerializer(t *testing.T) {
+	r := NewRouter(JSON)
+	protocol := NewMockProtocol()
+	ctx := NewContext(protocol, r, 0, JSON)
+	echo := func(u *TestUser) *TestUser {
+		return &TestUser{Id: u.Id + 1, Name: u.Name}
+	}
+	r.AddRoute("json", echo)
+	r.AddRoute("pb", echo, WithSerializer(Protobuf))
+
+	call := func(code string, s Serializer, ctxSerializer Serializer) *Packet {
+		ctx.setSerializer(ctxSerializer, "")
+		payload, err := s.Marshal(&TestUser{Id: 1, Name: "abc"})
+		assert.Nil(t, err)
+		err = r.emitPacket(ctx, &Packet{
+			Flag:    FlagWaitResponse,
+			Code:    code,
+			Payload: payload,
+		})
+		assert.Nil(t, err)
+		reply, _ := protocol.ReadPacket()
+		return reply
+	}
+
+	// pinned for the param and the reply
+	for _, cs := range []Serializer{JSON, Msgpack} {
+		reply := call("pb", Protobuf, cs)
+		assert.Equal(t, "", reply.Code)
+		u := &TestUser{}
+		assert.Nil(t, Protobuf.Unmarshal(reply.Payload, u))
+		assert.Equal(t, TestUser{Id: 2, Name: "abc"}, *u)
+		assert.NotNil(t, JSON.Unmarshal(reply.Payload, &TestUser{}))
+	}
+
+	// other routes use the serializer of the connection
+	reply := call("json", JSON, JSON)
+	u := &TestUser{}
+	assert.Nil(t, JSON.Unmarshal(reply.Payload, u))
+	assert.Equal(t, int32(2), u.Id)
+	reply = call("json", Msgpack, Msgpack)
+	u = &TestUser{}
+	assert.Nil(t, Msgpack.Unmarshal(reply.Payload, u))
+	assert.Equal(t, int32(2), u.Id)
+
+	// a Context without one uses the Router's, swapped for the routes added
+	// before too
+	r.SetSerializer(Msgpack)
+	reply = call("json", Msgpack, nil)
+	u = &TestUser{}
+	assert.Nil(t, Msgpack.Unmarshal(reply.Payload, u))
+	assert.Equal(t, int32(2), u.Id)
+	assert.Equal(t, Msgpack, ctx.Serializer())
+}
+
+type testShape interface {
+	Area() int32
+}
+
+type testSquare struct {
+	Side int32 `json:"side"`
+}
+
+func (s *testSquare) Area() int32 {
+	return s.Side * s.Side
+}
+
+type testCircle struct{}
+
+func (testCircle) Area() int32 {
+	return 3
+}
+
+func TestRouteParams(t *testing.T) {
+	r := NewRouter(JSON)
+	protocol := NewMockProtocol()
+	ctx := NewContext(protocol, r, 0, JSON)
+	call := func(code string, message Message) string {
+		payload, err := MessageToBytes(message, JSON)
+		assert.Nil(t, err)
+		err = r.emitPacket(ctx, &Packet{
+			Flag:    FlagWaitResponse,
+			Code:    code,
+			Payload: payload,
+		})
+		assert.Nil(t, err)
+		reply, _ := protocol.ReadPacket()
+		assert.Equal(t, "", reply.Code)
+		return string(reply.Payload)
+	}
+
+	r.AddRoute("value", func(u TestUser) TestUser {
+		u.Id++
+		return u
+	})
+	assert.Equal(t, `{"id":2,"name":"a"}`, call("value", &TestUser{Id: 1, Name: "a"}))
+	r.AddRoute("map", func(m map[string]int32) int32 {
+		return m["a"] + m["b"]
+	})
+	assert.Equal(t, "3", call("map", map[string]int32{"a": 1, "b": 2}))
+	r.AddRoute("slice", func(users []TestUser) int {
+		return len(users)
+	})
+	assert.Equal(t, "2", call("slice", []TestUser{{Id: 1}, {Id: 2}}))
+	r.AddRoute("int", func(ctx *Context, n int) int {
+		return n * 2
+	})
+	assert.Equal(t, "4", call("int", 2))
+	r.AddRoute("bool", func(b bool) bool {
+		return !b
+	})
+	assert.Equal(t, "false", call("bool", true))
+	r.AddRoute("any", func(v interface{}) interface{} {
+		return v
+	})
+	assert.Equal(t, `{"a":1}`, call("any", map[string]int{"a": 1}))
+
+	// interfaces are resolved by the registry
+	typesLock.Lock()
+	delete(types, reflect.TypeOf((*testShape)(nil)).Elem())
+	typesLock.Unlock()
+	assert.Panics(t, func() {
+		r.AddRoute("shape", func(s testShape) int32 {
+			return s.Area()
+		})
+	})
+	assert.Panics(t, func() {
+		RegisterType((*testShape)(nil), &TestUser{})
+	})
+	assert.Panics(t, func() {
+		RegisterType(testCircle{}, testCircle{})
+	})
+	RegisterType((*testShape)(nil), &testSquare{})
+	r.AddRoute("shape", func(s testShape) int32 {
+		return s.Area()
+	})
+	assert.Equal(t, "9", call("shape", &testSquare{Side: 3}))
+
+	// tagged messages are decoded as the type of their name
+	RegisterTypeName((*testShape)(nil), "square", &testSquare{})
+	RegisterTypeName((*testShape)(nil), "circle", testCircle{})
+	assert.Equal(t, "16", call("shape", Typed(&testSquare{Side: 4})))
+	assert.Equal(t, "3", call("shape", Typed(testCircle{})))
+	assert.Equal(t, "4", call("shape", &testSquare{Side: 2}))
+	assert.Panics(t, func() {
+		Typed(&TestUser{})
+	})
+	assert.Panics(t, func() {
+		RegisterTypeName((*testShape)(nil), "other", &testSquare{})
+	})
+	// registered after the route was added
+	RegisterType((*testShape)(nil), testCircle{})
+	assert.Equal(t, "3", call("shape", &testSquare{Side: 2}))
+	// the tag is read by any serializer of structs
+	ctx.setSerializer(Msgpack, "")
+	payload, err := MessageToBytes(Typed(&testSquare{Side: 5}), Msgpack)
+	assert.Nil(t, err)
+	assert.Nil(t, r.emitPacket(ctx, &Packet{Flag: FlagWaitResponse, Code: "shape", Payload: payload}))
+	reply, _ := protocol.ReadPacket()
+	var area int32
+	assert.Nil(t, Msgpack.Unmarshal(reply.Payload, &area))
+	assert.Equal(t, int32(25), area)
+	ctx.setSerializer(JSON, "")
+	// unknown names are invalid
+	err = r.emitPacket(ctx, &Packet{
+		Flag:    FlagWaitResponse,
+		Code:    "shape",
+		Payload: []byte(`{"type":"triangle","value":{}}`),
+	})
+	assert.Nil(t, err)
+	reply, _ = protocol.ReadPacket()
+	assert.Equal(t, ErrInvalidArgument, reply.Code)
+
+	// decode errors are replied as ErrInvalidArgument
+	err = r.emitPacket(ctx, &Packet{
+		Flag:    FlagWaitResponse,
+		Code:    "int",
+		Payload: []byte("abc"),
+	})
+	assert.Nil(t, err)
+	reply, _ = protocol.ReadPacket()
+	assert.Equal(t, ErrInvalidArgument, reply.Code)
+	invalid, ok := AsInvalidArgument(newReplyError(reply.Code, reply))
+	assert.True(t, ok)
+	assert.NotEqual(t, "", invalid.Message)
+}
+
+func benchmarkRoute(b *testing.B, handler HandlerFunc, message Message) {
+	s := JSON
+	payload, _ := MessageToBytes(message, s)
+	r := NewRouter(s)
+	ctx := NewContext(newTcpProtocol(nil, ioutil.Discard, false), r, 0, s)
+	r.AddRoute("bench", handler)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := acquirePacket()
+		pkt.Flag = FlagWaitResponse
+		pkt.Code = "bench"
+		pkt.Payload = payload
+		if err := r.emitPacket(ctx, pkt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRouteBytes(b *testing.B) {
+	benchmarkRoute(b, func(ctx *Context, in []byte) ([]byte, error) {
+		return in, nil
+	}, []byte("hello"))
+}
+
+func BenchmarkRouteMessage(b *testing.B) {
+	benchmarkRoute(b, func(ctx *Context, in *TestUser) (*TestUser, error) {
+		return in, nil
+	}, &TestUser{Id: 1, Name: "hello"})
+}
@@ -3,6 +3,7 @@ package flyrpc
 import (
 	"encoding/json"
 	"reflect"
+	"sync"
 )
 
 type Message interface{}
@@ -28,6 +29,26 @@ type Serializer interface {
 	Unmarshal([]byte, interface{}) error
 }
 
+// AppendSerializer marshals into a given buffer, the payloads it sends are
+// then pooled.
+type AppendSerializer interface {
+	Serializer
+	MarshalAppend([]byte, interface{}) ([]byte, error)
+}
+
+// messageToBuffer is MessageToBytes, pooled tells to putBuffer the payload
+// once sent.
+func messageToBuffer(message Message, serializer Serializer) (payload []byte, pooled bool, err error) {
+	s, ok := serializer.(AppendSerializer)
+	messageType := reflect.TypeOf(message)
+	if !ok || messageType == typeBytes || messageType == typeString {
+		payload, err = MessageToBytes(message, serializer)
+		return payload, false, err
+	}
+	payload, err = s.MarshalAppend(getBuffer(0), message)
+	return payload, err == nil, err
+}
+
 type serializer struct {
 	marshal   func(interface{}) ([]byte, error)
 	unmarshal func([]byte, interface{}) error
@@ -51,3 +72,30 @@ func (s *serializer) Unmarshal(bytes []byte, msg interface{}) error {
 var (
 	JSON Serializer = NewSerializer(json.Marshal, json.Unmarshal)
 )
+
+// serializers by name, a connection may switch to any of them, see
+// UseSerializer.
+var (
+	serializersLock sync.RWMutex
+	serializers     = map[string]Serializer{
+		"json":     JSON,
+		"msgpack":  Msgpack,
+		"protobuf": Protobuf,
+		"cbor":     CBOR,
+		"gob":      Gob,
+	}
+)
+
+// RegisterSerializer adds or replaces the serializer of name.
+func RegisterSerializer(name string, serializer Serializer) {
+	serializersLock.Lock()
+	defer serializersLock.Unlock()
+	serializers[name] = serializer
+}
+
+// GetSerializer returns the serializer registered as name, nil if none.
+func GetSerializer(name string) Serializer {
+	serializersLock.RLock()
+	defer serializersLock.RUnlock()
+	return serializers[name]
+}
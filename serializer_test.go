@@ -21,6 +21,18 @@ func (m *TestUser) Reset()         { *m = TestUser{} }
 func (m *TestUser) String() string { return proto.CompactTextString(m) }
 func (*TestUser) ProtoMessage()    {}
 
+type TestGroup struct {
+	Name    string               `json:"name"`
+	Owner   *TestUser            `json:"owner"`
+	Parent  *TestGroup           `json:"parent"`
+	Users   []TestUser           `json:"users"`
+	Roles   map[string]string    `json:"roles"`
+	ByName  map[string]*TestUser `json:"by_name"`
+	Avatar  []byte               `json:"avatar"`
+	Deleted bool                 `json:"deleted"`
+}
+
+// testSerializer is the conformance suite of the schemaless serializers.
 func testSerializer(t *testing.T, s Serializer) {
 	bytes, err := s.Marshal(&TestUser{Id: 123, Name: "abc"})
 	assert.Nil(t, err)
@@ -29,31 +41,117 @@ func testSerializer(t *testing.T, s Serializer) {
 	assert.Nil(t, err)
 	assert.Equal(t, int32(123), u.Id)
 	assert.Equal(t, "abc", u.Name)
+
+	// nested structs, maps, nil pointers and binary
+	group := &TestGroup{
+		Name:   "admin",
+		Owner:  &TestUser{Id: 1, Name: "root"},
+		Users:  []TestUser{{Id: 2, Name: "a"}, {Id: 3, Name: "b"}},
+		Roles:  map[string]string{"a": "reader", "b": "writer"},
+		ByName: map[string]*TestUser{"root": {Id: 1, Name: "root"}},
+		Avatar: []byte{0, 1, 2, 0xff},
+	}
+	bytes, err = s.Marshal(group)
+	assert.Nil(t, err)
+	g := &TestGroup{}
+	assert.Nil(t, s.Unmarshal(bytes, g))
+	assert.Equal(t, group, g)
+	assert.Nil(t, g.Parent)
+
+	// a nested group, binary is kept as it is
+	child := &TestGroup{Name: "child", Parent: group, Avatar: []byte("\x00abc")}
+	bytes, err = s.Marshal(child)
+	assert.Nil(t, err)
+	g = &TestGroup{}
+	assert.Nil(t, s.Unmarshal(bytes, g))
+	assert.Equal(t, "child", g.Name)
+	assert.Nil(t, g.Owner)
+	assert.Equal(t, []byte("\x00abc"), g.Avatar)
+	assert.Equal(t, group, g.Parent)
+
+	// maps as messages
+	bytes, err = s.Marshal(map[string]int32{"a": 1, "b": 2})
+	assert.Nil(t, err)
+	m := map[string]int32{}
+	assert.Nil(t, s.Unmarshal(bytes, &m))
+	assert.Equal(t, map[string]int32{"a": 1, "b": 2}, m)
+
+	// garbage is an error
+	assert.NotNil(t, s.Unmarshal([]byte{0xc1, 0xff, 0xff}, &TestGroup{}))
 }
 
 func TestJSONSerializer(t *testing.T) {
 	testSerializer(t, JSON)
 }
 
-/*
+func TestCBORSerializer(t *testing.T) {
+	testSerializer(t, CBOR)
+
+	// appended to the given buffer
+	bytes, err := CBOR.(AppendSerializer).MarshalAppend([]byte{1}, &TestUser{Id: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, byte(1), bytes[0])
+	u := &TestUser{}
+	assert.Nil(t, CBOR.Unmarshal(bytes[1:], u))
+	assert.Equal(t, int32(1), u.Id)
+}
+
+func TestGobSerializer(t *testing.T) {
+	testSerializer(t, Gob)
+}
+
+func TestMsgpack(t *testing.T) {
+	testSerializer(t, Msgpack)
+
+	// msgpack tags first, then json tags
+	type tagged struct {
+		Id    int32  `msgpack:"i" json:"id"`
+		Name  string `json:"n"`
+		Empty string `json:"e,omitempty"`
+	}
+	bytes, err := Msgpack.Marshal(&tagged{Id: 1, Name: "abc"})
+	assert.Nil(t, err)
+	m := map[string]interface{}{}
+	assert.Nil(t, Msgpack.Unmarshal(bytes, &m))
+	assert.Equal(t, 2, len(m))
+	assert.Equal(t, "abc", m["n"])
+	assert.NotNil(t, m["i"])
+	v := &tagged{}
+	assert.Nil(t, Msgpack.Unmarshal(bytes, v))
+	assert.Equal(t, tagged{Id: 1, Name: "abc"}, *v)
+
+	// appended to the given buffer
+	bytes, err = Msgpack.(AppendSerializer).MarshalAppend([]byte{1}, &TestUser{Id: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, byte(1), bytes[0])
+	u := &TestUser{}
+	assert.Nil(t, Msgpack.Unmarshal(bytes[1:], u))
+	assert.Equal(t, int32(1), u.Id)
+}
+
 func TestProtoSerializer(t *testing.T) {
 	uid := int32(123)
 	s := Protobuf
 	bytes, err := s.Marshal(&TestNoneProto{Id: uid, Name: "abc"})
 	assert.NotNil(t, err)
+	assert.Equal(t, ErrNotProtoMessage, err.(*ReplyError).code)
 	bytes, err = s.Marshal(&TestUser{Id: uid, Name: "abc"})
 	assert.Nil(t, err)
 	m := &TestNoneProto{}
 	err = s.Unmarshal(bytes, m)
 	assert.NotNil(t, err)
+	assert.Equal(t, ErrNotProtoMessage, err.(*ReplyError).code)
 	u := &TestUser{}
 	err = s.Unmarshal(bytes, u)
 	assert.Nil(t, err)
 	assert.Equal(t, uid, u.Id)
 	assert.Equal(t, "abc", u.Name)
-}
 
-func TestMsgpack(t *testing.T) {
-	testSerializer(t, Msgpack)
+	// appended to the given buffer
+	bytes, err = s.(AppendSerializer).MarshalAppend([]byte{1}, u)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(1), bytes[0])
+	u = &TestUser{}
+	assert.Nil(t, s.Unmarshal(bytes[1:], u))
+	assert.Equal(t, uid, u.Id)
 }
-*/
@@ -4,44 +4,81 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 )
 
 type ServerOpts struct {
 	Serializer Serializer
 	Multiplex  bool
+	// MaxCodeLength of received packets, default DefaultMaxCodeLength, up to
+	// MaxCodeLengthLimit
+	MaxCodeLength int
+	// MaxPayloadLength of received packets, default DefaultMaxPayloadLength.
+	// The peer gets ErrBuffTooLong and the connection is closed.
+	MaxPayloadLength TLength
+	// Flow bounds the handlers run for each client, default unbounded
+	Flow *FlowOpts
+	// Order of the handlers of each client, default concurrent
+	Order OrderKey
+	// Validator of the messages decoded for the handlers, the Validate
+	// method of the messages runs anyway
+	Validator ValidateFunc
+	// Serializers the clients may switch to with UseSerializer, default any
+	// registered one
+	Serializers []string
 }
 
 type Server struct {
 	Router          Router
 	multiplex       bool
-	serializer      Serializer
 	listener        net.Listener
 	transports      []*transport
 	contextMap      map[int]*Context
+	lock            sync.RWMutex
 	connectHandlers []func(*Context)
 	nextClientId    int
+	// packet limits of every connection
+	maxCodeLength    int
+	maxPayloadLength TLength
+	flow             *FlowOpts
+	order            OrderKey
+	validator        ValidateFunc
+	serializers      []string
 }
 
 type transport struct {
-	protocol  Protocol
-	server    *Server
-	multiplex bool
-	context   *Context
-	clientIds []int
+	protocol   Protocol
+	server     *Server
+	multiplex  bool
+	remoteAddr string
+	// context of a not multiplexed transport
+	context *Context
+	// contexts by clientId
+	contexts     map[int]*Context
+	contextsLock sync.Mutex
 }
 
 func NewServer(opts *ServerOpts) *Server {
 	if opts.Serializer == nil {
 		opts.Serializer = JSON
 	}
+	if err := checkLimits(opts.MaxCodeLength); err != nil {
+		panic(err)
+	}
 	return &Server{
 		Router:          NewRouter(opts.Serializer),
 		multiplex:       opts.Multiplex,
-		serializer:      opts.Serializer,
 		transports:      make([]*transport, 0),
 		contextMap:      make(map[int]*Context),
 		connectHandlers: make([]func(*Context), 0),
 		nextClientId:    0,
+
+		maxCodeLength:    opts.MaxCodeLength,
+		maxPayloadLength: opts.MaxPayloadLength,
+		flow:             opts.Flow,
+		order:            opts.Order,
+		validator:        opts.Validator,
+		serializers:      opts.Serializers,
 	}
 }
 
@@ -49,12 +86,41 @@ func (s *Server) Broadcast(clientIds []int, code string, v Message) error {
 	return nil
 }
 
+// GetContext returns the Context of a client. ClientIds are assigned by the
+// server, in multiplex mode too, the ids of the gateways are kept per link.
 func (s *Server) GetContext(clientId int) *Context {
-	// TODO 考虑多路复用情况, 多个client会共享一个transport
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.contextMap[clientId]
 }
 
+// NumContexts returns the count of connected clients.
+func (s *Server) NumContexts() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.contextMap)
+}
+
+func (s *Server) setContext(clientId int, ctx *Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.contextMap[clientId] != nil {
+		log.Println("Duplicated clientId", clientId)
+	}
+	s.contextMap[clientId] = ctx
+}
+
+func (s *Server) deleteContext(clientId int, ctx *Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.contextMap[clientId] == ctx {
+		delete(s.contextMap, clientId)
+	}
+}
+
 func (s *Server) GetNextClientId() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.nextClientId++
 	return s.nextClientId
 }
@@ -67,8 +133,8 @@ func (s *Server) OnConnect(connectHandler func(*Context)) {
 	s.connectHandlers = append(s.connectHandlers, connectHandler)
 }
 
-func (s *Server) OnMessage(code string, handler HandlerFunc) {
-	s.Router.AddRoute(code, handler)
+func (s *Server) OnMessage(code string, handler HandlerFunc, opts ...RouteOption) {
+	s.Router.AddRoute(code, handler, opts...)
 }
 
 func (s *Server) emitContext(ctx *Context) {
@@ -92,7 +158,10 @@ func (s *Server) Listen(network, addr string) error {
 }
 
 func (s *Server) Close() error {
-	for _, t := range s.transports {
+	s.lock.RLock()
+	transports := s.transports
+	s.lock.RUnlock()
+	for _, t := range transports {
 		t.Close()
 	}
 	err := s.listener.Close()
@@ -108,28 +177,46 @@ func (s *Server) handleConnections() {
 		} else {
 			log.Println("New Connection", conn.RemoteAddr())
 		}
-		s.transports = append(s.transports, newTransport(conn, s))
+		newTransport(conn, s)
+	}
+}
+
+func (s *Server) addTransport(t *transport) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.transports = append(s.transports, t)
+}
+
+func (s *Server) removeTransport(t *transport) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, v := range s.transports {
+		if v == t {
+			s.transports = append(s.transports[:i:i], s.transports[i+1:]...)
+			break
+		}
 	}
 }
 
 func newTransport(conn net.Conn, server *Server) *transport {
 	protocol := NewTcpProtocol(conn, server.IsMultiplex())
+	protocol.setLimits(server.maxCodeLength, server.maxPayloadLength)
 	transport := &transport{
-		protocol: protocol,
-		server:   server,
+		protocol:   protocol,
+		server:     server,
+		remoteAddr: conn.RemoteAddr().String(),
+		contexts:   make(map[int]*Context),
 	}
 	if server.IsMultiplex() {
-		// DO NOTHING
-		// TODO somewhere wait message to add clientId
-		// For a frontend multiplex server
-		// TODO Make standalone frontend server
-		// TODO dispatch clientId to a connected backend server
+		// logical clients join with CodeClientJoin from a gateway
 		transport.multiplex = true
 	} else {
-		ctx := transport.addClient(server.GetNextClientId())
+		ctx := transport.addClient(0)
+		ctx.RemoteAddr = transport.remoteAddr
 		transport.context = ctx
 		server.emitContext(ctx)
 	}
+	server.addTransport(transport)
 	go transport.handlePackets()
 	return transport
 }
@@ -142,52 +229,158 @@ func (t *transport) handlePackets() {
 				log.Println("Close on error", err)
 			}
 			t.Close()
+			t.server.removeTransport(t)
 			break
 		}
-		go t.emitPacket(packet)
+		t.dispatchPacket(packet)
 	}
 }
 
-func (t *transport) emitPacket(pkt *Packet) {
-	if t.multiplex {
-		clientId := pkt.ClientId
-		t.getContext(clientId).emitPacket(pkt)
-	} else {
-		t.context.emitPacket(pkt)
+func (t *transport) dispatchPacket(pkt *Packet) {
+	if !t.multiplex {
+		t.context.dispatchPacket(pkt)
+		return
+	}
+	if pkt.Flag&FlagResponse == 0 {
+		switch pkt.Code {
+		case CodeClientJoin:
+			t.joinClient(pkt.ClientId, string(pkt.Payload))
+			return
+		case CodeClientLeave:
+			t.removeClient(pkt.ClientId)
+			return
+		case CodePing:
+			replyPing(t.protocol, pkt)
+			return
+		}
+	}
+	ctx := t.getContext(pkt.ClientId)
+	if ctx == nil {
+		t.dropPacket(pkt)
+		return
 	}
+	pkt.ClientId = ctx.ClientId
+	ctx.dispatchPacket(pkt)
 }
 
+// dropPacket drops a packet of a client which left or was never joined, e.g.
+// late after CodeClientLeave. The gateway is told the client left.
+func (t *transport) dropPacket(pkt *Packet) {
+	clientId, flag := pkt.ClientId, pkt.Flag
+	pkt.Release()
+	if flag&FlagResponse != 0 {
+		return
+	}
+	t.protocol.SendPacket(&Packet{
+		ClientId: clientId,
+		Code:     CodeClientLeave,
+		Payload:  []byte{},
+	})
+}
+
+// joinClient creates the Context of a logical client behind a gateway.
+func (t *transport) joinClient(clientId int, remoteAddr string) *Context {
+	t.contextsLock.Lock()
+	ctx := t.contexts[clientId]
+	t.contextsLock.Unlock()
+	if ctx != nil {
+		return ctx
+	}
+	ctx = t.addClient(clientId)
+	ctx.RemoteAddr = remoteAddr
+	t.server.emitContext(ctx)
+	return ctx
+}
+
+// getContext returns nil if the client did not join with CodeClientJoin.
+// Contexts of the transport are keyed by the clientId of the gateway.
 func (t *transport) getContext(clientId int) *Context {
-	context := t.server.contextMap[clientId]
-	if context == nil {
-		return t.addClient(clientId)
+	t.contextsLock.Lock()
+	defer t.contextsLock.Unlock()
+	return t.contexts[clientId]
+}
+
+// addClient creates a Context with a new clientId of the server, linkId is the
+// clientId of the gateway in multiplex mode.
+func (t *transport) addClient(linkId int) *Context {
+	var protocol Protocol = t.protocol
+	if t.multiplex {
+		protocol = &muxProtocol{t.protocol, t, linkId}
+	}
+	clientId := t.server.GetNextClientId()
+	// the serializer of the Router until negotiated, see Router.SetSerializer
+	context := NewContext(protocol, t.server.Router, clientId, nil)
+	context.SetOrder(t.server.order)
+	context.SetValidator(t.server.validator)
+	context.AllowSerializers(t.server.serializers...)
+	if t.server.flow != nil {
+		if err := context.SetFlowControl(t.server.flow); err != nil {
+			log.Println("Grant credits error", clientId, err)
+		}
 	}
+	t.contextsLock.Lock()
+	t.contexts[linkId] = context
+	t.contextsLock.Unlock()
+	t.server.setContext(clientId, context)
 	return context
 }
 
-func (t *transport) addClient(clientId int) *Context {
-	t.clientIds = append(t.clientIds, clientId)
-	context := NewContext(t.protocol, t.server.Router, clientId, t.server.serializer)
-	t.server.contextMap[clientId] = context
+// deleteClient unregisters a client, it returns nil if already removed.
+func (t *transport) deleteClient(clientId int) *Context {
+	t.contextsLock.Lock()
+	context := t.contexts[clientId]
+	delete(t.contexts, clientId)
+	t.contextsLock.Unlock()
+	if context != nil {
+		t.server.deleteContext(context.ClientId, context)
+	}
 	return context
 }
 
 func (t *transport) removeClient(clientId int) *Context {
-	// TODO remove clientId from clientIds
-	// remove context from server.contextMap
-	context := t.server.contextMap[clientId]
+	context := t.deleteClient(clientId)
 	if context != nil {
 		context.Close()
 	}
-	delete(t.server.contextMap, clientId)
 	return context
 }
 
 func (t *transport) Close() error {
 	// remove all clients
-	for _, id := range t.clientIds {
+	t.contextsLock.Lock()
+	clientIds := make([]int, 0, len(t.contexts))
+	for id := range t.contexts {
+		clientIds = append(clientIds, id)
+	}
+	t.contextsLock.Unlock()
+	for _, id := range clientIds {
 		t.removeClient(id)
 	}
-	t.clientIds = nil
 	return t.protocol.Close()
 }
+
+// muxProtocol is the Protocol of a logical client on a multiplexed link.
+// Closing it kicks the client from the gateway instead of closing the link.
+type muxProtocol struct {
+	Protocol
+	transport *transport
+	// clientId of the gateway
+	clientId int
+}
+
+func (p *muxProtocol) SendPacket(pkt *Packet) error {
+	pkt.ClientId = p.clientId
+	return p.Protocol.SendPacket(pkt)
+}
+
+func (p *muxProtocol) Close() error {
+	if p.transport.deleteClient(p.clientId) == nil {
+		// already left
+		return nil
+	}
+	return p.Protocol.SendPacket(&Packet{
+		ClientId: p.clientId,
+		Code:     CodeClientLeave,
+		Payload:  []byte{},
+	})
+}
@@ -1,6 +1,7 @@
 package flyrpc
 
 import (
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -69,6 +70,87 @@ func TestServerHandlePacket(t *testing.T) {
 	server.Close()
 }
 
+func TestServerLimits(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer:       JSON,
+		MaxPayloadLength: 100,
+	})
+	server.OnMessage("echo", func(in []byte) []byte {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15557")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15557")
+	disconnected := make(chan error, 1)
+	client.OnDisconnect(func(err error) {
+		disconnected <- err
+	})
+	_, err := client.GetReply("echo", make([]byte, 100))
+	assert.NoError(t, err)
+	_, err = client.GetReply("echo", make([]byte, 101))
+	assert.Error(t, err)
+	assert.Equal(t, ErrBuffTooLong, err.Error())
+	<-disconnected
+	server.Close()
+}
+
+func TestServerMultiplexLinks(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Multiplex:  true,
+	})
+	contexts := make(chan *Context, 2)
+	server.OnConnect(func(ctx *Context) {
+		contexts <- ctx
+	})
+	server.OnMessage("whoami", func(ctx *Context) string {
+		return ctx.RemoteAddr
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15614")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	// two gateways number their clients alike
+	links := make([]*TcpProtocol, 2)
+	ids := make(map[int]bool)
+	for i, addr := range []string{"a", "b"} {
+		conn, err := net.Dial("tcp", "127.0.0.1:15614")
+		assert.NoError(t, err)
+		links[i] = NewTcpProtocol(conn, true)
+		links[i].SendPacket(&Packet{ClientId: 1, Code: CodeClientJoin, Payload: []byte(addr)})
+		ids[(<-contexts).ClientId] = true
+	}
+	assert.Equal(t, 2, len(ids))
+	assert.Equal(t, 2, server.NumContexts())
+
+	// each link reaches its own client, with the id of its gateway
+	for i, addr := range []string{"a", "b"} {
+		links[i].SendPacket(&Packet{ClientId: 1, Flag: FlagWaitResponse, Code: "whoami", Seq: 1, Payload: []byte{}})
+		pkt, err := links[i].ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, pkt.ClientId)
+		assert.Equal(t, addr, string(pkt.Payload))
+	}
+
+	// leaving one link keeps the other client
+	links[0].SendPacket(&Packet{ClientId: 1, Code: CodeClientLeave, Payload: []byte{}})
+	<-time.After(10 * time.Millisecond)
+	assert.Equal(t, 1, server.NumContexts())
+	links[1].SendPacket(&Packet{ClientId: 1, Flag: FlagWaitResponse, Code: "whoami", Seq: 2, Payload: []byte{}})
+	pkt, err := links[1].ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(pkt.Payload))
+
+	links[0].Close()
+	links[1].Close()
+	server.Close()
+}
+
 /*
 func TestServer(t *testing.T) {
 	server := NewServer(&ServerOpts{
@@ -127,3 +209,160 @@ func testClient(t *testing.T, wg *sync.WaitGroup, i int) {
 	})
 }
 */
+
+func TestServerMultiplex(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Multiplex:  true,
+	})
+	contexts := make(chan *Context, 2)
+	closed := make(chan int, 2)
+	server.OnConnect(func(ctx *Context) {
+		ctx.Session = ctx.ClientId
+		ctx.OnClose(func(ctx *Context) {
+			closed <- ctx.ClientId
+		})
+		contexts <- ctx
+	})
+	server.OnMessage("whoami", func(ctx *Context) (*TestUser, error) {
+		return &TestUser{Id: int32(ctx.Session.(int))}, nil
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15611")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	gateway := NewGateway(&GatewayOpts{
+		Backends: []string{"127.0.0.1:15611"},
+	})
+	go func() {
+		err := gateway.Listen("tcp", "127.0.0.1:15612")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	c1 := makeClient(t, "127.0.0.1:15612")
+	ctx1 := <-contexts
+	c2 := makeClient(t, "127.0.0.1:15612")
+	ctx2 := <-contexts
+	assert.NotEqual(t, ctx1.ClientId, ctx2.ClientId)
+	assert.NotEqual(t, "", ctx1.RemoteAddr)
+	assert.Equal(t, 2, server.NumContexts())
+	assert.Equal(t, ctx1, server.GetContext(ctx1.ClientId))
+
+	// calls are answered by the context of each client
+	u := &TestUser{}
+	assert.NoError(t, c1.Call("whoami", nil, u))
+	assert.Equal(t, int32(ctx1.ClientId), u.Id)
+	assert.NoError(t, c2.Call("whoami", nil, u))
+	assert.Equal(t, int32(ctx2.ClientId), u.Id)
+
+	// server calls a client through the gateway
+	c2.OnMessage("ping", func(in string) string {
+		return "pong:" + in
+	})
+	bytes, err := ctx2.GetReply("ping", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, "pong:2", string(bytes))
+
+	// client leaves
+	c1.Close()
+	assert.Equal(t, ctx1.ClientId, <-closed)
+	assert.Nil(t, server.GetContext(ctx1.ClientId))
+
+	// server kicks a client, the link stays up
+	ctx2.Close()
+	assert.Equal(t, ctx2.ClientId, <-closed)
+	<-time.After(10 * time.Millisecond)
+	assert.Equal(t, 0, gateway.NumClients())
+	assert.Equal(t, 0, server.NumContexts())
+
+	c3 := makeClient(t, "127.0.0.1:15612")
+	ctx3 := <-contexts
+	assert.NoError(t, c3.Call("whoami", nil, u))
+	assert.Equal(t, int32(ctx3.ClientId), u.Id)
+
+	gateway.Close()
+	server.Close()
+}
+
+func TestServerMultiplexLeave(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Multiplex:  true,
+	})
+	contexts := make(chan *Context, 2)
+	server.OnConnect(func(ctx *Context) {
+		contexts <- ctx
+	})
+	server.OnMessage("hello", func(in string) string {
+		return "hello:" + in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15613")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	conn, err := net.Dial("tcp", "127.0.0.1:15613")
+	assert.NoError(t, err)
+	gateway := NewTcpProtocol(conn, true)
+
+	gateway.SendPacket(&Packet{ClientId: 5, Code: CodeClientJoin, Payload: []byte("addr")})
+	ctx := <-contexts
+	assert.Equal(t, ctx, server.GetContext(ctx.ClientId))
+	gateway.SendPacket(&Packet{ClientId: 5, Code: CodeClientLeave, Payload: []byte{}})
+
+	// a late packet does not join again, the gateway is told to leave
+	gateway.SendPacket(&Packet{ClientId: 5, Flag: FlagWaitResponse, Code: "hello", Seq: 1, Payload: []byte("a")})
+	pkt, err := gateway.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, CodeClientLeave, pkt.Code)
+	assert.Equal(t, 5, pkt.ClientId)
+	assert.Nil(t, server.GetContext(ctx.ClientId))
+	assert.Equal(t, 0, server.NumContexts())
+	select {
+	case <-contexts:
+		t.Fatal("ghost context")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// joined again
+	gateway.SendPacket(&Packet{ClientId: 5, Code: CodeClientJoin, Payload: []byte("addr")})
+	<-contexts
+	gateway.SendPacket(&Packet{ClientId: 5, Flag: FlagWaitResponse, Code: "hello", Seq: 2, Payload: []byte("b")})
+	pkt, err = gateway.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello:b", string(pkt.Payload))
+
+	gateway.Close()
+	server.Close()
+}
+
+func TestServerSetSerializer(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	server.OnMessage("echo", func(in *TestUser) *TestUser {
+		return in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15615")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15615")
+
+	u := &TestUser{}
+	assert.NoError(t, client.Call("echo", &TestUser{Id: 1, Name: "a"}, u))
+	assert.Equal(t, "a", u.Name)
+	// the route added before and the connected clients follow the swap
+	server.Router.SetSerializer(Msgpack)
+	client.SetSerializer(Msgpack)
+	assert.NoError(t, client.Call("echo", &TestUser{Id: 2, Name: "b"}, u))
+	assert.Equal(t, TestUser{Id: 2, Name: "b"}, *u)
+	bytes, err := client.GetReply("echo", &TestUser{Id: 3})
+	assert.NoError(t, err)
+	assert.NotNil(t, JSON.Unmarshal(bytes, u))
+	client.Close()
+	server.Close()
+}
@@ -0,0 +1,267 @@
+package flyrpc
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ServiceOpts configures a ServiceClient.
+type ServiceOpts struct {
+	// Network to dial endpoints, default "tcp"
+	Network string
+	// Resolver of the service name, required
+	Resolver Resolver
+	// Balancer picks a connection per call, default RoundRobinBalancer
+	Balancer Balancer
+	// Serializer of every connection, default JSON
+	Serializer Serializer
+	// RefreshInterval between resolutions, default 10 seconds. Lost
+	// endpoints are dialed again on refresh.
+	RefreshInterval time.Duration
+	// MaxCodeLength of received packets, default DefaultMaxCodeLength
+	MaxCodeLength int
+	// MaxPayloadLength of received packets, default DefaultMaxPayloadLength.
+	// A bigger reply fails the call and closes the connection.
+	MaxPayloadLength TLength
+}
+
+// ServiceClient targets a service name. It keeps one connection per
+// resolved endpoint and spreads calls across the healthy ones.
+type ServiceClient struct {
+	service string
+	opts    *ServiceOpts
+	router  Router
+	lock    sync.RWMutex
+	// interceptors of every connection
+	interceptors []Interceptor
+	conns        []*ServiceConn
+	closed       bool
+	closeChan    chan bool
+	// refreshLock runs one Refresh at once, removed are the clients lost
+	// since the last one
+	refreshLock sync.Mutex
+	removed     map[*Client]bool
+}
+
+// ServiceConn is the connection of a ServiceClient to one endpoint.
+type ServiceConn struct {
+	Endpoint
+	*Client
+}
+
+var _ Caller = &ServiceClient{}
+
+// DialService resolves service and dials its endpoints. It fails if none
+// could be dialed.
+func DialService(service string, opts *ServiceOpts) (*ServiceClient, error) {
+	if opts.Resolver == nil {
+		return nil, newError("service require a resolver")
+	}
+	if opts.Network == "" {
+		opts.Network = "tcp"
+	}
+	if opts.Balancer == nil {
+		opts.Balancer = RoundRobinBalancer()
+	}
+	if opts.Serializer == nil {
+		opts.Serializer = JSON
+	}
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = 10 * time.Second
+	}
+	s := &ServiceClient{
+		service:   service,
+		opts:      opts,
+		router:    NewRouter(opts.Serializer),
+		conns:     make([]*ServiceConn, 0),
+		closeChan: make(chan bool),
+		removed:   make(map[*Client]bool),
+	}
+	if err := s.Refresh(); err != nil {
+		return nil, err
+	}
+	if len(s.Conns()) == 0 {
+		return nil, newError(ErrDisconnected)
+	}
+	go s.refreshLoop()
+	return s, nil
+}
+
+func (s *ServiceClient) refreshLoop() {
+	ticker := time.NewTicker(s.opts.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeChan:
+			return
+		case <-ticker.C:
+		}
+		if err := s.Refresh(); err != nil {
+			log.Println("Resolve error", s.service, err)
+		}
+	}
+}
+
+// Refresh resolves the service now, dials new endpoints and closes removed
+// ones.
+func (s *ServiceClient) Refresh() error {
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+	endpoints, err := s.opts.Resolver.Resolve(s.service)
+	if err != nil {
+		return err
+	}
+	old := make(map[string]*ServiceConn)
+	for _, conn := range s.Conns() {
+		old[conn.Addr] = conn
+	}
+	conns := make([]*ServiceConn, 0, len(endpoints))
+	for _, ep := range endpoints {
+		conn := old[ep.Addr]
+		if conn != nil {
+			delete(old, ep.Addr)
+			conn = &ServiceConn{ep, conn.Client}
+		} else if conn, err = s.dial(ep); err != nil {
+			log.Println("Dial error", ep.Addr, err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return newError(ErrWriterClosed)
+	}
+	// lost while resolving, until the next refresh
+	alive := conns[:0]
+	for _, conn := range conns {
+		if !s.removed[conn.Client] {
+			alive = append(alive, conn)
+		}
+	}
+	s.conns = alive
+	s.removed = make(map[*Client]bool)
+	s.lock.Unlock()
+	for _, conn := range old {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *ServiceClient) dial(ep Endpoint) (*ServiceConn, error) {
+	protocol, err := dialProtocol(s.opts.Network, ep.Addr, s.opts.MaxCodeLength, s.opts.MaxPayloadLength)
+	if err != nil {
+		return nil, err
+	}
+	c := newClientWith(protocol, s.opts.Serializer, func(c *Client) {
+		c.Router = s.router
+		c.RemoteAddr = ep.Addr
+		s.lock.RLock()
+		c.interceptors = s.interceptors
+		s.lock.RUnlock()
+	})
+	c.OnDisconnect(func(err error) {
+		s.remove(c)
+	})
+	return &ServiceConn{ep, c}, nil
+}
+
+// remove a lost connection until the next refresh.
+func (s *ServiceClient) remove(c *Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removed[c] = true
+	conns := make([]*ServiceConn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		if conn.Client != c {
+			conns = append(conns, conn)
+		}
+	}
+	s.conns = conns
+}
+
+// Conns returns the healthy connections.
+func (s *ServiceClient) Conns() []*ServiceConn {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.conns
+}
+
+// Pick returns the connection chosen by the Balancer.
+func (s *ServiceClient) Pick() (*ServiceConn, error) {
+	conns := s.Conns()
+	if len(conns) == 0 {
+		return nil, newError(ErrDisconnected)
+	}
+	return s.opts.Balancer.Pick(conns), nil
+}
+
+// PickClient implements ClientPicker.
+func (s *ServiceClient) PickClient() (*Client, error) {
+	conn, err := s.Pick()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Client, nil
+}
+
+// Use adds interceptors to the calls of every connection, see Context.Use.
+func (s *ServiceClient) Use(interceptors ...Interceptor) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.interceptors = append(s.interceptors[:len(s.interceptors):len(s.interceptors)], interceptors...)
+	for _, conn := range s.conns {
+		conn.Use(interceptors...)
+	}
+}
+
+// OnMessage handles messages sent by any endpoint.
+func (s *ServiceClient) OnMessage(code string, handler HandlerFunc, opts ...RouteOption) {
+	s.router.AddRoute(code, handler, opts...)
+}
+
+func (s *ServiceClient) SendMessage(code string, message Message, opts ...CallOption) error {
+	conn, err := s.Pick()
+	if err != nil {
+		return err
+	}
+	return conn.SendMessage(code, message, opts...)
+}
+
+func (s *ServiceClient) GetReply(code string, message Message, opts ...CallOption) ([]byte, error) {
+	conn, err := s.Pick()
+	if err != nil {
+		return nil, err
+	}
+	return conn.GetReply(code, message, opts...)
+}
+
+func (s *ServiceClient) Call(code string, message Message, reply Message, opts ...CallOption) error {
+	conn, err := s.Pick()
+	if err != nil {
+		return err
+	}
+	return conn.Call(code, message, reply, opts...)
+}
+
+func (s *ServiceClient) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closeChan)
+	conns := s.conns
+	s.conns = nil
+	s.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package flyrpc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceClient(t *testing.T) {
+	addrs := []string{"127.0.0.1:15651", "127.0.0.1:15652"}
+	servers := make([]*Server, len(addrs))
+	for i, addr := range addrs {
+		server := NewServer(&ServerOpts{
+			Serializer: JSON,
+		})
+		name := addr
+		server.OnMessage("where", func() string {
+			return name
+		})
+		go func() {
+			err := server.Listen("tcp", name)
+			assert.Nil(t, err)
+		}()
+		servers[i] = server
+	}
+	<-time.After(10 * time.Millisecond)
+
+	resolved := addrs
+	client, err := DialService("echo", &ServiceOpts{
+		Resolver: ResolverFunc(func(service string) ([]Endpoint, error) {
+			assert.Equal(t, "echo", service)
+			return StaticResolver(resolved...).Resolve(service)
+		}),
+		RefreshInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(client.Conns()))
+
+	counts := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		bytes, err := client.GetReply("where", nil)
+		assert.NoError(t, err)
+		counts[string(bytes)]++
+	}
+	assert.Equal(t, map[string]int{addrs[0]: 2, addrs[1]: 2}, counts)
+
+	// a lost endpoint is not used anymore
+	servers[0].Close()
+	<-time.After(20 * time.Millisecond)
+	assert.Equal(t, 1, len(client.Conns()))
+	for i := 0; i < 2; i++ {
+		bytes, err := client.GetReply("where", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, addrs[1], string(bytes))
+	}
+
+	// removed endpoints are closed on refresh
+	resolved = addrs[1:]
+	assert.NoError(t, client.Refresh())
+	assert.Equal(t, 1, len(client.Conns()))
+	resolved = nil
+	assert.NoError(t, client.Refresh())
+	_, err = client.GetReply("where", nil)
+	assert.Error(t, err)
+
+	client.Close()
+	servers[1].Close()
+}
+
+func TestServiceRefreshRace(t *testing.T) {
+	addrs := []string{"127.0.0.1:15653", "127.0.0.1:15654"}
+	contexts := make(chan *Context, 10)
+	for _, addr := range addrs {
+		server := NewServer(&ServerOpts{
+			Serializer: JSON,
+		})
+		server.OnConnect(func(ctx *Context) {
+			contexts <- ctx
+		})
+		name := addr
+		go func() {
+			err := server.Listen("tcp", name)
+			assert.Nil(t, err)
+		}()
+		defer server.Close()
+	}
+	<-time.After(10 * time.Millisecond)
+
+	var lock sync.Mutex
+	resolved := addrs[:1]
+	var onResolve func()
+	client, err := DialService("echo", &ServiceOpts{
+		Resolver: ResolverFunc(func(service string) ([]Endpoint, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if onResolve != nil {
+				onResolve()
+			}
+			return StaticResolver(resolved...).Resolve(service)
+		}),
+		RefreshInterval: time.Hour,
+	})
+	assert.NoError(t, err)
+	first := <-contexts
+
+	// concurrent refreshes dial a new endpoint once
+	lock.Lock()
+	resolved = addrs
+	lock.Unlock()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, client.Refresh())
+		}()
+	}
+	wg.Wait()
+	<-contexts
+	assert.Equal(t, 2, len(client.Conns()))
+	select {
+	case <-contexts:
+		t.Fatal("dialed twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// lost while refreshing, never installed again
+	for i := 0; i < 10; i++ {
+		lock.Lock()
+		onResolve = func() {
+			select {
+			case ctx := <-contexts:
+				ctx.Close()
+			default:
+				first.Close()
+			}
+		}
+		lock.Unlock()
+		assert.NoError(t, client.Refresh())
+	}
+	lock.Lock()
+	onResolve = nil
+	lock.Unlock()
+	<-time.After(20 * time.Millisecond)
+	for _, conn := range client.Conns() {
+		assert.NoError(t, conn.Ping(0, time.Second), conn.Addr)
+	}
+	assert.NoError(t, client.Refresh())
+	assert.Equal(t, 2, len(client.Conns()))
+
+	client.Close()
+}
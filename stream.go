@@ -0,0 +1,377 @@
+package flyrpc
+
+import (
+	"io"
+	"sync"
+)
+
+// Stream carries many messages in both directions under a single Seq.
+//
+// The caller opens it with Context.OpenStream, the handler of the code takes
+// a *Stream param and the stream ends when the handler returns. Both sides
+// Send and Recv until CloseSend or an error termination. A side which stops
+// reading must Close the stream, the connection stops reading while it is
+// full.
+type Stream struct {
+	ctx  *Context
+	code string
+	seq  TSeq
+	// outFlag is FlagResponse on the accepting side
+	outFlag  byte
+	recvChan chan *Packet
+	// doneChan is closed when nobody reads the stream anymore
+	doneChan chan bool
+	doneOnce sync.Once
+	lock     sync.Mutex
+	sendDone bool
+	recvDone bool
+	recvErr  error
+	canceled bool
+	writer   *streamWriter
+	// serializer pinned by the route, nil for the one of the Context
+	serializer Serializer
+}
+
+// streamRecvBuffer is the count of packets queued by a Stream, the
+// connection stops reading while it is full.
+const streamRecvBuffer = 64
+
+func newStream(ctx *Context, code string, seq TSeq, outFlag byte) *Stream {
+	return &Stream{
+		ctx:      ctx,
+		code:     code,
+		seq:      seq,
+		outFlag:  outFlag,
+		recvChan: make(chan *Packet, streamRecvBuffer),
+		doneChan: make(chan bool),
+	}
+}
+
+// OpenStream opens a stream to the handler of code, message is decoded as
+// the handler message param.
+func (ctx *Context) OpenStream(code string, message Message) (*Stream, error) {
+	if err := ctx.credits.acquire(nil, nil); err != nil {
+		return nil, err
+	}
+	// sent with the serializer it is encoded with, see UseSerializer
+	ctx.switching.RLock()
+	defer ctx.switching.RUnlock()
+	payload, err := MessageToBytes(message, ctx.Serializer())
+	if err != nil {
+		ctx.credits.refund()
+		return nil, err
+	}
+	s := newStream(ctx, code, ctx.getNextSeq(), 0)
+	ctx.setStream(ctx.streams, s.seq, s)
+	err = ctx.Protocol.SendPacket(&Packet{
+		ClientId: ctx.ClientId,
+		Flag:     FlagStream | FlagWaitResponse,
+		Code:     code,
+		Seq:      s.seq,
+		Payload:  payload,
+	})
+	if err != nil {
+		ctx.setStream(ctx.streams, s.seq, nil)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Context returns the Context of the stream.
+func (s *Stream) Context() *Context {
+	return s.ctx
+}
+
+// Code returns the code the stream was opened with.
+func (s *Stream) Code() string {
+	return s.code
+}
+
+func (s *Stream) send(flag byte, code string, payload []byte) error {
+	return s.sendPriority(flag, code, payload, PriorityInteractive)
+}
+
+func (s *Stream) sendPriority(flag byte, code string, payload []byte, priority Priority) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sendDone {
+		return newError(ErrStreamClosed)
+	}
+	if flag&FlagStreamEnd != 0 {
+		s.sendDone = true
+	}
+	return s.ctx.Protocol.SendPacket(&Packet{
+		ClientId: s.ctx.ClientId,
+		Flag:     FlagStream | s.outFlag | flag,
+		Code:     code,
+		Seq:      s.seq,
+		Payload:  payload,
+		Priority: priority,
+	})
+}
+
+// Send sends a message to the other side.
+func (s *Stream) Send(message Message) error {
+	// sent with the serializer it is encoded with, see UseSerializer
+	s.ctx.switching.RLock()
+	defer s.ctx.switching.RUnlock()
+	payload, pooled, err := messageToBuffer(message, s.getSerializer())
+	if err != nil {
+		return err
+	}
+	if pooled {
+		defer putBuffer(payload)
+	}
+	return s.send(0, "", payload)
+}
+
+// CloseSend tells the other side that no more message will be sent, its
+// Recv returns io.EOF.
+func (s *Stream) CloseSend() error {
+	return s.send(FlagStreamEnd, "", []byte{})
+}
+
+// CloseWithError ends sending with an error code, Recv of the other side
+// returns it as a ReplyError.
+func (s *Stream) CloseWithError(err error) error {
+	return s.send(FlagStreamEnd, err.Error(), []byte{})
+}
+
+// Close stops sending and receiving. The other side is canceled: its Recv
+// returns ErrCanceled and its Send ErrStreamClosed, what it sent meanwhile is
+// dropped.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.canceled {
+		s.lock.Unlock()
+		return nil
+	}
+	s.canceled = true
+	s.sendDone = true
+	if !s.recvDone {
+		s.recvDone = true
+		s.recvErr = newError(ErrCanceled)
+	}
+	s.lock.Unlock()
+	if s.outFlag == 0 {
+		s.ctx.setStream(s.ctx.streams, s.seq, nil)
+	}
+	s.stopRecv()
+	return s.ctx.Protocol.SendPacket(&Packet{
+		ClientId: s.ctx.ClientId,
+		Flag:     FlagStream | s.outFlag | FlagStreamEnd,
+		Code:     ErrCanceled,
+		Seq:      s.seq,
+		Payload:  []byte{},
+		Priority: PriorityControl,
+	})
+}
+
+// stopRecv drops the queued packets and the next ones.
+func (s *Stream) stopRecv() {
+	s.doneOnce.Do(func() {
+		close(s.doneChan)
+	})
+	for {
+		select {
+		case pkt := <-s.recvChan:
+			pkt.Release()
+		default:
+			return
+		}
+	}
+}
+
+// canceledByPeer ends the stream closed by the other side.
+func (s *Stream) canceledByPeer(pkt *Packet) {
+	s.lock.Lock()
+	s.sendDone = true
+	s.lock.Unlock()
+	pkt.Release()
+	s.fail(ErrCanceled)
+}
+
+// RecvBytes returns the next payload, io.EOF once the other side closed, or
+// the error it closed with.
+func (s *Stream) RecvBytes() ([]byte, error) {
+	pkt, err := s.recvPacket()
+	if err != nil {
+		return nil, err
+	}
+	return pkt.Payload, nil
+}
+
+func (s *Stream) recvPacket() (*Packet, error) {
+	s.lock.Lock()
+	if s.recvDone {
+		s.lock.Unlock()
+		return nil, s.recvErr
+	}
+	s.lock.Unlock()
+	var pkt *Packet
+	select {
+	case pkt = <-s.recvChan:
+	case <-s.doneChan:
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.recvDone {
+			return nil, s.recvErr
+		}
+		return nil, newError(ErrStreamClosed)
+	}
+	if pkt.Flag&FlagStreamEnd == 0 {
+		return pkt, nil
+	}
+	var err error = io.EOF
+	if pkt.Code != "" {
+		err = newReplyError(pkt.Code, pkt)
+	}
+	s.lock.Lock()
+	s.recvDone = true
+	s.recvErr = err
+	s.lock.Unlock()
+	return nil, err
+}
+
+// Recv decodes the next message with the serializer of the Context, or the
+// one pinned by the route.
+func (s *Stream) Recv(message Message) error {
+	bytes, err := s.RecvBytes()
+	if err != nil {
+		return err
+	}
+	return s.getSerializer().Unmarshal(bytes, message)
+}
+
+func (s *Stream) getSerializer() Serializer {
+	if s.serializer != nil {
+		return s.serializer
+	}
+	return s.ctx.Serializer()
+}
+
+// push queues a received packet, it blocks while the stream is full. The
+// packet is dropped once the stream is closed.
+func (s *Stream) push(pkt *Packet) {
+	select {
+	case s.recvChan <- pkt:
+	case <-s.doneChan:
+		pkt.Release()
+	}
+}
+
+// fail ends receiving with an error code, e.g. when disconnected.
+func (s *Stream) fail(code string) {
+	select {
+	case s.recvChan <- &Packet{Flag: FlagStream | FlagStreamEnd, Code: code, Seq: s.seq}:
+	default:
+		// full, the reader will see the error after
+		go s.push(&Packet{Flag: FlagStream | FlagStreamEnd, Code: code, Seq: s.seq})
+	}
+}
+
+func (ctx *Context) setStream(streams map[TSeq]*Stream, seq TSeq, s *Stream) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if s == nil {
+		delete(streams, seq)
+	} else {
+		streams[seq] = s
+	}
+}
+
+func (ctx *Context) getStream(streams map[TSeq]*Stream, seq TSeq) *Stream {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return streams[seq]
+}
+
+// acceptedStream returns the stream opened by the peer with seq.
+func (ctx *Context) acceptedStream(seq TSeq) *Stream {
+	return ctx.getStream(ctx.acceptedStreams, seq)
+}
+
+// emitStreamPacket runs in the reading goroutine to keep the order of
+// stream packets.
+func (ctx *Context) emitStreamPacket(pkt *Packet) {
+	if pkt.Flag&FlagResponse != 0 {
+		// from the handler of a stream we opened
+		s := ctx.getStream(ctx.streams, pkt.Seq)
+		if s == nil {
+			// closed by us
+			ctx.debug("No stream found, pkt is :", pkt)
+			pkt.Release()
+			return
+		}
+		if pkt.Flag&FlagStreamEnd != 0 {
+			ctx.setStream(ctx.streams, pkt.Seq, nil)
+		}
+		s.push(pkt)
+		return
+	}
+	s := ctx.acceptedStream(pkt.Seq)
+	if s != nil {
+		if pkt.Flag&FlagStreamEnd != 0 && pkt.Code == ErrCanceled {
+			s.canceledByPeer(pkt)
+			return
+		}
+		s.push(pkt)
+		return
+	}
+	if pkt.Flag&FlagWaitResponse == 0 || pkt.Code == "" {
+		// the handler already returned
+		pkt.Release()
+		return
+	}
+	// open a stream
+	s = newStream(ctx, pkt.Code, pkt.Seq, FlagResponse)
+	ctx.setStream(ctx.acceptedStreams, pkt.Seq, s)
+	if ctx.Router.GetRoute(pkt.Code) == nil {
+		ctx.endStream(s, newError(ErrNotFound))
+		if flow := ctx.getFlow(); flow != nil {
+			flow.done()
+		}
+		return
+	}
+	ctx.runHandler(pkt)
+}
+
+// endStream is called when the handler of an accepted stream returns.
+func (ctx *Context) endStream(s *Stream, err error) error {
+	ctx.setStream(ctx.acceptedStreams, s.seq, nil)
+	s.stopRecv()
+	s.lock.Lock()
+	done := s.sendDone
+	writer := s.writer
+	s.lock.Unlock()
+	if writer != nil && !done {
+		if flushErr := writer.Flush(); flushErr != nil && err == nil {
+			err = flushErr
+		}
+	}
+	if done {
+		// closed by the handler
+		return nil
+	}
+	if err != nil {
+		return s.CloseWithError(err)
+	}
+	return s.CloseSend()
+}
+
+// failStreams ends receiving of every stream with an error code.
+func (ctx *Context) failStreams(code string) {
+	ctx.lock.Lock()
+	streams := make([]*Stream, 0, len(ctx.streams)+len(ctx.acceptedStreams))
+	for seq, s := range ctx.streams {
+		streams = append(streams, s)
+		delete(ctx.streams, seq)
+	}
+	for _, s := range ctx.acceptedStreams {
+		streams = append(streams, s)
+	}
+	ctx.lock.Unlock()
+	for _, s := range streams {
+		s.fail(code)
+	}
+}
@@ -0,0 +1,192 @@
+package flyrpc
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStream(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	contexts := make(chan *Context, 1)
+	server.OnConnect(func(ctx *Context) {
+		contexts <- ctx
+	})
+	// server stream
+	server.OnMessage("tail", func(ctx *Context, in *TestUser, s *Stream) error {
+		for i := int32(0); i < in.Id; i++ {
+			if err := s.Send(&TestUser{Id: i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// client stream
+	server.OnMessage("sum", func(s *Stream) error {
+		sum := int32(0)
+		u := &TestUser{}
+		for {
+			err := s.Recv(u)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			sum += u.Id
+		}
+		return s.Send(&TestUser{Id: sum})
+	})
+	// bidirectional stream
+	server.OnMessage("echo", func(s *Stream) error {
+		for {
+			bytes, err := s.RecvBytes()
+			if err == io.EOF {
+				return nil
+			}
+			if string(bytes) == "boom" {
+				return newError("BOOM")
+			}
+			s.Send(bytes)
+		}
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15671")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15671")
+	ctx := <-contexts
+
+	s, err := client.OpenStream("tail", &TestUser{Id: 100})
+	assert.NoError(t, err)
+	u := &TestUser{}
+	for i := int32(0); i < 100; i++ {
+		assert.NoError(t, s.Recv(u))
+		assert.Equal(t, i, u.Id)
+	}
+	assert.Equal(t, io.EOF, s.Recv(u))
+	assert.Equal(t, io.EOF, s.Recv(u))
+
+	s, err = client.OpenStream("sum", nil)
+	assert.NoError(t, err)
+	for i := int32(1); i <= 10; i++ {
+		assert.NoError(t, s.Send(&TestUser{Id: i}))
+	}
+	assert.NoError(t, s.CloseSend())
+	assert.Error(t, s.Send(&TestUser{}))
+	assert.NoError(t, s.Recv(u))
+	assert.Equal(t, int32(55), u.Id)
+	assert.Equal(t, io.EOF, s.Recv(u))
+
+	s, err = client.OpenStream("echo", nil)
+	assert.NoError(t, err)
+	for _, word := range []string{"a", "b", "c"} {
+		assert.NoError(t, s.Send(word))
+		bytes, err := s.RecvBytes()
+		assert.NoError(t, err)
+		assert.Equal(t, word, string(bytes))
+	}
+	assert.NoError(t, s.Send("boom"))
+	_, err = s.RecvBytes()
+	assert.Error(t, err)
+	assert.Equal(t, "BOOM", err.Error())
+
+	s, err = client.OpenStream("missing", nil)
+	assert.NoError(t, err)
+	_, err = s.RecvBytes()
+	assert.Equal(t, ErrNotFound, err.Error())
+
+	// server opens a stream to the client
+	client.OnMessage("feed", func(s *Stream) error {
+		s.Send("x")
+		return s.CloseWithError(newError("DONE"))
+	})
+	s, err = ctx.OpenStream("feed", nil)
+	assert.NoError(t, err)
+	bytes, err := s.RecvBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, "x", string(bytes))
+	_, err = s.RecvBytes()
+	assert.Equal(t, "DONE", err.Error())
+
+	// disconnected
+	s, err = client.OpenStream("echo", nil)
+	assert.NoError(t, err)
+	ctx.Close()
+	_, err = s.RecvBytes()
+	assert.Equal(t, ErrDisconnected, err.Error())
+
+	server.Close()
+}
+
+func TestStreamClose(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+	})
+	sendErrs := make(chan error, 1)
+	server.OnMessage("tail", func(s *Stream) error {
+		for i := int32(0); ; i++ {
+			if err := s.Send(&TestUser{Id: i}); err != nil {
+				sendErrs <- err
+				return err
+			}
+		}
+	})
+	recvErrs := make(chan error, 1)
+	server.OnMessage("sink", func(s *Stream) error {
+		_, err := s.RecvBytes()
+		recvErrs <- err
+		return err
+	})
+	server.OnMessage("hello", func(in string) string {
+		return "hello:" + in
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15672")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15672")
+
+	// abandoned after one message, the connection keeps reading
+	s, err := client.OpenStream("tail", nil)
+	assert.NoError(t, err)
+	u := &TestUser{}
+	assert.NoError(t, s.Recv(u))
+	<-time.After(20 * time.Millisecond)
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+	bytes, err := client.GetReply("hello", "a", WithPriority(PriorityInteractive))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello:a", string(bytes))
+	select {
+	case err := <-sendErrs:
+		assert.Equal(t, ErrStreamClosed, err.Error())
+	case <-time.After(time.Second):
+		t.Fatal("handler not canceled")
+	}
+	assert.Equal(t, ErrCanceled, s.Recv(u).Error())
+	assert.Equal(t, ErrStreamClosed, s.Send(u).Error())
+
+	// the handler receives ErrCanceled
+	s, err = client.OpenStream("sink", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+	select {
+	case err := <-recvErrs:
+		assert.Equal(t, ErrCanceled, err.Error())
+	case <-time.After(time.Second):
+		t.Fatal("handler not canceled")
+	}
+	bytes, err = client.GetReply("hello", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello:b", string(bytes))
+
+	client.Close()
+	server.Close()
+}
@@ -6,6 +6,9 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
 )
 
 type TcpProtocol struct {
@@ -13,8 +16,56 @@ type TcpProtocol struct {
 	Conn net.Conn
 	// Reader
 	Reader *bufio.Reader
-	// Writer
+	// Writer buffers SendHeader and its payload, the connection is owned
+	// from SendHeader until the packet is flushed, see SendHeader.
 	Writer *bufio.Writer
+	// writer is written by the writer loop only
+	writer io.Writer
+	// multiplex packets carry a ClientId on the wire
+	multiplex bool
+	// queue of SendPacket for the writer loop, by priority
+	queue writeQueue
+	// codes received, shared by the packets
+	codes map[string]string
+	// pending bytes of the queue owner, cut around big payloads
+	header    []byte
+	cuts      []payloadCut
+	bufs      net.Buffers
+	startOnce sync.Once
+	closeOnce sync.Once
+	// owned bytes of Writer still to write, see SendHeader
+	ownLock sync.Mutex
+	owned   int
+	// MaxCodeLength of received packets, default DefaultMaxCodeLength, up to
+	// MaxCodeLengthLimit
+	MaxCodeLength int
+	// MaxPayloadLength of received packets, default DefaultMaxPayloadLength.
+	// Bigger payloads should be sent in chunks, see Context.Upload.
+	MaxPayloadLength TLength
+}
+
+const (
+	DefaultMaxCodeLength    = 1024
+	DefaultMaxPayloadLength = 16 * 1024 * 1024
+	// MaxCodeLengthLimit is the longest code the read buffer holds
+	MaxCodeLengthLimit = readBufferSize - 1
+)
+
+const (
+	// maxBatchPackets and maxBatchBytes bound a write of the writer loop, so
+	// that a late control packet does not wait for the whole queue.
+	maxBatchPackets = 64
+	maxBatchBytes   = 256 * 1024
+	// payloads up to copyPayloadLength are copied next to their header,
+	// bigger ones are written in place
+	copyPayloadLength = 512
+	// readBufferSize holds the longest code, see MaxCodeLength
+	readBufferSize = 4096
+)
+
+type payloadCut struct {
+	at      int
+	payload []byte
 }
 
 func NewTcpProtocol(conn net.Conn, isMultiplex bool) *TcpProtocol {
@@ -26,129 +77,298 @@ func NewTcpProtocol(conn net.Conn, isMultiplex bool) *TcpProtocol {
 	return protocol
 }
 
+// checkLimits rejects a code length the read buffer cannot hold.
+func checkLimits(maxCodeLength int) error {
+	if maxCodeLength > MaxCodeLengthLimit {
+		return newError("MaxCodeLength is up to " + strconv.Itoa(MaxCodeLengthLimit))
+	}
+	return nil
+}
+
+// setLimits overrides the default limits with the non-zero ones.
+func (p *TcpProtocol) setLimits(maxCodeLength int, maxPayloadLength TLength) {
+	if maxCodeLength > 0 {
+		p.MaxCodeLength = maxCodeLength
+	}
+	if maxPayloadLength > 0 {
+		p.MaxPayloadLength = maxPayloadLength
+	}
+}
+
 func newTcpProtocol(reader io.Reader, writer io.Writer, isMultiplex bool) *TcpProtocol {
 	p := &TcpProtocol{
-		Reader: bufio.NewReader(reader),
-		Writer: bufio.NewWriter(writer),
+		Reader:    bufio.NewReaderSize(reader, readBufferSize),
+		writer:    writer,
+		multiplex: isMultiplex,
+		queue:     newWriteQueue(),
+
+		MaxCodeLength:    DefaultMaxCodeLength,
+		MaxPayloadLength: DefaultMaxPayloadLength,
 	}
+	p.Writer = bufio.NewWriter(&ownedWriter{p: p})
 	return p
 }
 
 func (p *TcpProtocol) Close() error {
-	if p.Conn != nil || !reflect.ValueOf(p.Conn).IsNil() {
-		return p.Conn.Close()
-	}
-	return nil
+	var err error
+	p.closeOnce.Do(func() {
+		p.queue.close(newError(ErrWriterClosed))
+		if p.Conn != nil {
+			err = p.Conn.Close()
+		}
+	})
+	return err
 }
 
+// SendPacket queues the packet for the writer loop and waits until it is
+// written, an idle connection is written directly. It is safe for
+// concurrent use.
 func (p *TcpProtocol) SendPacket(pk *Packet) error {
-	// log.Println("Sending:", pk.ClientId, pk.Header, pk.MsgBuff)
-	if p.Writer == nil {
-		err := p.Close()
-		return newFlyError(ErrWriterClosed, err)
-	}
-	if p.Writer.Available() == 0 {
-		return newError(ErrWriterClosed)
-	}
-	// if support zip {
-	// TODO zip
-	// payload = zip(payload)
-	// }
+	priority := pk.Priority
+	if isControlCode(pk.Code) {
+		priority = PriorityControl
+	}
 	if pk.Length == 0 {
 		pk.Length = TLength(len(pk.Payload))
 	}
-	// write Header
-	if err := p.SendHeader(pk); err != nil {
+	if p.queue.tryWrite() {
+		p.encode(pk)
+		err := p.flush()
+		p.queue.doneWrite()
 		return err
 	}
-	if int(pk.Length)+len(pk.Code) > 1300 {
-		// flush header first
-		if err := p.Writer.Flush(); err != nil {
-			return err
+	p.startOnce.Do(func() {
+		go p.writeLoop()
+	})
+	req := &writeRequest{pkt: pk, done: make(chan error, 1)}
+	if err := p.queue.push(req, priority); err != nil {
+		return err
+	}
+	return <-req.done
+}
+
+// writeLoop writes the queued packets, coalescing them under load.
+func (p *TcpProtocol) writeLoop() {
+	for {
+		if !p.queue.wait() {
+			return
+		}
+		// let concurrent senders queue up, for a bigger batch
+		runtime.Gosched()
+		batch, ok := p.queue.pop(maxBatchPackets, maxBatchBytes)
+		if !ok {
+			return
+		}
+		for _, req := range batch {
+			p.encode(req.pkt)
+		}
+		err := p.flush()
+		p.queue.doneWrite()
+		for _, req := range batch {
+			req.done <- err
+		}
+		if err != nil {
+			return
 		}
 	}
-	// TODO make Big payload write more effecient
-	// write Payload
-	if _, err := p.Writer.Write(pk.Payload); err != nil {
-		return err
+}
+
+// encode appends the header and a small payload to the pending bytes, a big
+// payload is written in place. Only the owner of the queue may call it.
+func (p *TcpProtocol) encode(pk *Packet) {
+	p.header = p.appendHeader(p.header, pk)
+	if len(pk.Payload) <= copyPayloadLength {
+		p.header = append(p.header, pk.Payload...)
+	} else {
+		p.cuts = append(p.cuts, payloadCut{len(p.header), pk.Payload})
+	}
+}
+
+// flush writes the encoded packets with a single vectored write, a write
+// error closes the connection.
+func (p *TcpProtocol) flush() error {
+	from := 0
+	for i, c := range p.cuts {
+		p.bufs = append(p.bufs, p.header[from:c.at], c.payload)
+		from = c.at
+		p.cuts[i].payload = nil
+	}
+	if from < len(p.header) {
+		p.bufs = append(p.bufs, p.header[from:])
+	}
+	var err error
+	if len(p.bufs) == 1 {
+		_, err = p.writer.Write(p.bufs[0])
+	} else {
+		bufs := p.bufs
+		_, err = bufs.WriteTo(p.writer)
 	}
-	return p.Writer.Flush()
+	for i := range p.bufs {
+		p.bufs[i] = nil
+	}
+	p.bufs = p.bufs[:0]
+	p.cuts = p.cuts[:0]
+	p.header = p.header[:0]
+	if cap(p.header) > maxBatchBytes {
+		// do not keep a buffer grown by a big batch
+		p.header = nil
+	}
+	if err != nil {
+		p.queue.close(newFlyError(ErrWriterClosed, err))
+		if p.Conn != nil {
+			p.Conn.Close()
+		}
+	}
+	return err
 }
 
+// SendHeader writes the header of pk to Writer, its payload of pk.Length
+// bytes should follow then Writer be flushed. It waits for the packets being
+// written and holds the connection until the payload is written, other
+// packets are queued meanwhile.
 func (p *TcpProtocol) SendHeader(pk *Packet) error {
-	bitsOfLength := 8
+	header := p.appendHeader(nil, pk)
+	if err := p.own(len(header) + int(pk.Length)); err != nil {
+		return err
+	}
+	_, err := p.Writer.Write(header)
+	return err
+}
+
+// ownedWriter is under Writer, it writes to the connection while owning it.
+type ownedWriter struct {
+	p *TcpProtocol
+}
+
+func (w *ownedWriter) Write(b []byte) (int, error) {
+	p := w.p
+	p.ownLock.Lock()
+	defer p.ownLock.Unlock()
+	if p.owned == 0 {
+		// raw bytes without SendHeader, owned for this write only
+		if err := p.queue.acquire(); err != nil {
+			return 0, err
+		}
+		p.owned = len(b)
+	}
+	n, err := p.writer.Write(b)
+	p.owned -= n
+	if err != nil {
+		p.queue.close(newFlyError(ErrWriterClosed, err))
+	}
+	if p.owned <= 0 || err != nil {
+		p.owned = 0
+		p.queue.doneWrite()
+	}
+	return n, err
+}
+
+// own waits until the connection is idle and holds it for n more bytes of
+// Writer.
+func (p *TcpProtocol) own(n int) error {
+	p.ownLock.Lock()
+	defer p.ownLock.Unlock()
+	if p.owned == 0 {
+		if err := p.queue.acquire(); err != nil {
+			return err
+		}
+	}
+	p.owned += n
+	return nil
+}
+
+func (p *TcpProtocol) appendHeader(buf []byte, pk *Packet) []byte {
+	// clear length bits, a forwarded packet may carry them already
+	pk.Flag = pk.Flag &^ FlagLenPayload
 	if pk.Length > 0xffffffff {
-		bitsOfLength = 64
 		pk.Flag = pk.Flag | 0x03
 	} else if pk.Length > 0xffff {
-		bitsOfLength = 32
 		pk.Flag = pk.Flag | 0x02
 	} else if pk.Length > 0xff {
-		bitsOfLength = 16
 		pk.Flag = pk.Flag | 0x01
 	}
 
-	// write Flag
-	if err := binary.Write(p.Writer, binary.BigEndian, pk.Flag); err != nil {
-		return err
+	// write ClientId
+	if p.multiplex {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(pk.ClientId))
 	}
-
+	// write Flag
+	buf = append(buf, pk.Flag)
 	// write Seq
-	if err := binary.Write(p.Writer, binary.BigEndian, pk.Seq); err != nil {
-		return err
-	}
-
+	buf = binary.BigEndian.AppendUint16(buf, uint16(pk.Seq))
 	// write Code
-	if _, err := p.Writer.WriteString(pk.Code); err != nil {
-		return err
-	}
-	if err := p.Writer.WriteByte(0); err != nil {
-		return err
-	}
-
+	buf = append(buf, pk.Code...)
+	buf = append(buf, 0)
 	// write Payload Length
-	if bitsOfLength == 8 {
-		if err := p.Writer.WriteByte(byte(pk.Length)); err != nil {
-			return err
-		}
-	} else if bitsOfLength == 16 {
-		if err := binary.Write(p.Writer, binary.BigEndian, uint16(pk.Length)); err != nil {
-			return err
-		}
-	} else if bitsOfLength == 32 {
-		if err := binary.Write(p.Writer, binary.BigEndian, uint32(pk.Length)); err != nil {
-			return err
-		}
-	} else if bitsOfLength == 64 {
-		if err := binary.Write(p.Writer, binary.BigEndian, uint64(pk.Length)); err != nil {
-			return err
-		}
+	switch pk.Flag & FlagLenPayload {
+	case 0:
+		buf = append(buf, byte(pk.Length))
+	case 1:
+		buf = binary.BigEndian.AppendUint16(buf, uint16(pk.Length))
+	case 2:
+		buf = binary.BigEndian.AppendUint32(buf, uint32(pk.Length))
+	default:
+		buf = binary.BigEndian.AppendUint64(buf, uint64(pk.Length))
 	}
-	return nil
+	return buf
 }
 
 func (p *TcpProtocol) ReadPacket() (*Packet, error) {
-	pkt := &Packet{}
-
-	reader := p.Reader
+	pkt := acquirePacket()
 
 	if err := p.ReadHeader(pkt); err != nil {
+		if e, ok := err.(*ReplyError); ok && e.code == ErrBuffTooLong {
+			p.replyTooLong(pkt)
+		}
+		pkt.Release()
 		return nil, err
 	}
 
 	// read Payload
-	pkt.Payload = make([]byte, pkt.Length)
-	if _, err := io.ReadFull(reader, pkt.Payload); err != nil {
-		return nil, err
+	if pkt.Length == 0 {
+		pkt.Payload = []byte{}
+	} else {
+		pkt.buf = getBuffer(int(pkt.Length))
+		pkt.Payload = pkt.buf
+		if _, err := io.ReadFull(p.Reader, pkt.Payload); err != nil {
+			pkt.Release()
+			return nil, err
+		}
 	}
 	// TODO unzip
 	return pkt, nil
 }
 
+// readUint reads a big endian integer of n bytes.
+func (p *TcpProtocol) readUint(n int) (uint64, error) {
+	b, err := p.Reader.Peek(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	p.Reader.Discard(n)
+	return v, nil
+}
+
+// maxCodes bounds the received codes kept to avoid allocating them again.
+const maxCodes = 256
+
 func (p *TcpProtocol) ReadHeader(pkt *Packet) error {
 	reader := p.Reader
 
 	var err error
+	// read ClientId
+	if p.multiplex {
+		clientId, err := p.readUint(4)
+		if err != nil {
+			return err
+		}
+		pkt.ClientId = int(clientId)
+	}
+
 	// read Flag
 	pkt.Flag, err = reader.ReadByte()
 	if err != nil {
@@ -157,48 +377,61 @@ func (p *TcpProtocol) ReadHeader(pkt *Packet) error {
 	powOfLength := pkt.Flag & FlagLenPayload
 
 	// read Seq
-	var seq uint16
-	err = binary.Read(reader, binary.BigEndian, &seq)
+	seq, err := p.readUint(2)
 	if err != nil {
 		return err
 	}
 	pkt.Seq = TSeq(seq)
 
-	// read Code
-	code, err := reader.ReadString(0)
+	// read Code, in the buffer of reader
+	code, err := reader.ReadSlice(0)
+	if err == bufio.ErrBufferFull || len(code) > p.MaxCodeLength+1 {
+		return newFlyError(ErrBuffTooLong, nil)
+	}
 	if err != nil {
 		return err
 	}
-	pkt.Code = code[:len(code)-1]
-
-	// read length
-	if powOfLength == 0 {
-		l, err := reader.ReadByte()
-		if err != nil {
-			return err
-		}
-		pkt.Length = TLength(l)
-	} else if powOfLength == 1 {
-		var l uint16
-		err = binary.Read(reader, binary.BigEndian, &l)
-		if err != nil {
-			return err
+	code = code[:len(code)-1]
+	if s, ok := p.codes[string(code)]; ok {
+		pkt.Code = s
+	} else {
+		pkt.Code = string(code)
+		if p.codes == nil {
+			p.codes = make(map[string]string)
 		}
-		pkt.Length = TLength(l)
-	} else if powOfLength == 2 {
-		var l uint32
-		err = binary.Read(reader, binary.BigEndian, &l)
-		if err != nil {
-			return err
-		}
-		pkt.Length = TLength(l)
-	} else if powOfLength == 3 {
-		var l uint64
-		err = binary.Read(reader, binary.BigEndian, &l)
-		if err != nil {
-			return err
+		if len(p.codes) < maxCodes {
+			p.codes[pkt.Code] = pkt.Code
 		}
-		pkt.Length = TLength(l)
+	}
+
+	// read length
+	length, err := p.readUint(1 << powOfLength)
+	if err != nil {
+		return err
+	}
+	pkt.Length = TLength(length)
+	if pkt.Length > p.MaxPayloadLength {
+		return newFlyError(ErrBuffTooLong, nil)
 	}
 	return nil
 }
+
+// replyTooLong tells the peer why the connection is about to be closed.
+func (p *TcpProtocol) replyTooLong(pkt *Packet) {
+	if pkt.Flag&FlagResponse != 0 {
+		return
+	}
+	flag := FlagResponse
+	if pkt.Flag&FlagStream != 0 {
+		flag = flag | FlagStream | FlagStreamEnd
+	} else if pkt.Flag&FlagWaitResponse == 0 {
+		return
+	}
+	p.SendPacket(&Packet{
+		ClientId: pkt.ClientId,
+		Flag:     flag,
+		Seq:      pkt.Seq,
+		Code:     ErrBuffTooLong,
+		Payload:  []byte{},
+	})
+}
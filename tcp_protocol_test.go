@@ -1,9 +1,12 @@
 package flyrpc
 
 import (
+	"bytes"
+	"io/ioutil"
 	"log"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -42,3 +45,257 @@ func TestProtocolReal(t *testing.T) {
 	err = conn1.Close()
 	assert.Nil(t, err)
 }
+
+func TestProtocolMultiplex(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:17778")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	conn1, err := net.Dial("tcp", "127.0.0.1:17778")
+	assert.Nil(t, err)
+	p1 := NewTcpProtocol(conn1, true)
+
+	conn2, err := listener.Accept()
+	assert.Nil(t, err)
+	p2 := NewTcpProtocol(conn2, true)
+
+	err = p1.SendPacket(&Packet{
+		ClientId: 70000,
+		Flag:     FlagWaitResponse,
+		Code:     "222",
+		Seq:      123,
+		Payload:  make([]byte, 300),
+	})
+	assert.Nil(t, err)
+
+	pkt, err := p2.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, 70000, pkt.ClientId)
+	assert.Equal(t, "222", pkt.Code)
+	assert.Equal(t, TSeq(123), pkt.Seq)
+	assert.Equal(t, 300, len(pkt.Payload))
+
+	// forward the same packet, length bits must not pile up
+	err = p2.SendPacket(pkt)
+	assert.Nil(t, err)
+	pkt, err = p1.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(pkt.Payload))
+	conn1.Close()
+	conn2.Close()
+}
+
+func TestProtocolSendHeader(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	p1 := NewTcpProtocol(conn1, false)
+	p2 := NewTcpProtocol(conn2, false)
+	go func() {
+		pkt := &Packet{Code: "raw", Seq: 7, Length: 300}
+		assert.NoError(t, p1.SendHeader(pkt))
+		_, err := p1.Writer.Write(make([]byte, 300))
+		assert.NoError(t, err)
+		assert.NoError(t, p1.Writer.Flush())
+	}()
+	pkt, err := p2.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, "raw", pkt.Code)
+	assert.Equal(t, TSeq(7), pkt.Seq)
+	assert.Equal(t, 300, len(pkt.Payload))
+	p1.Close()
+	p2.Close()
+}
+
+func TestProtocolSendHeaderConcurrent(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	p1 := NewTcpProtocol(conn1, false)
+	p2 := NewTcpProtocol(conn2, false)
+	defer p1.Close()
+	defer p2.Close()
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			go func() {
+				assert.NoError(t, p1.SendPacket(&Packet{Code: "pkt", Payload: make([]byte, 1000)}))
+			}()
+			pkt := &Packet{Code: "raw", Length: 3000}
+			assert.NoError(t, p1.SendHeader(pkt))
+			// the payload in pieces, no packet may come in between
+			for j := 0; j < 3; j++ {
+				_, err := p1.Writer.Write(make([]byte, 1000))
+				assert.NoError(t, err)
+				assert.NoError(t, p1.Writer.Flush())
+				time.Sleep(time.Millisecond)
+			}
+		}
+		close(done)
+	}()
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		pkt, err := p2.ReadPacket()
+		if !assert.NoError(t, err) {
+			return
+		}
+		counts[pkt.Code]++
+		if pkt.Code == "raw" {
+			assert.Equal(t, 3000, len(pkt.Payload))
+		} else {
+			assert.Equal(t, 1000, len(pkt.Payload))
+		}
+	}
+	<-done
+	assert.Equal(t, map[string]int{"raw": 50, "pkt": 50}, counts)
+}
+
+func TestProtocolLimits(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:17779")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	conn1, err := net.Dial("tcp", "127.0.0.1:17779")
+	assert.Nil(t, err)
+	p1 := NewTcpProtocol(conn1, false)
+	defer p1.Close()
+
+	conn2, err := listener.Accept()
+	assert.Nil(t, err)
+	p2 := NewTcpProtocol(conn2, false)
+	p2.MaxCodeLength = 4
+	p2.MaxPayloadLength = 10
+
+	err = p1.SendPacket(&Packet{Flag: FlagWaitResponse, Code: "abcd", Seq: 1, Payload: make([]byte, 10)})
+	assert.Nil(t, err)
+	pkt, err := p2.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, "abcd", pkt.Code)
+
+	// payload too long, the peer gets the error
+	err = p1.SendPacket(&Packet{Flag: FlagWaitResponse, Code: "abcd", Seq: 2, Payload: make([]byte, 11)})
+	assert.Nil(t, err)
+	_, err = p2.ReadPacket()
+	assert.Equal(t, ErrBuffTooLong, err.Error())
+	pkt, err = p1.ReadPacket()
+	assert.Nil(t, err)
+	assert.Equal(t, FlagResponse, pkt.Flag&FlagResponse)
+	assert.Equal(t, TSeq(2), pkt.Seq)
+	assert.Equal(t, ErrBuffTooLong, pkt.Code)
+	p2.Close()
+
+	// code too long, no allocation for the announced payload
+	conn1, err = net.Dial("tcp", "127.0.0.1:17779")
+	assert.Nil(t, err)
+	p1 = NewTcpProtocol(conn1, false)
+	defer p1.Close()
+	conn2, err = listener.Accept()
+	assert.Nil(t, err)
+	p2 = NewTcpProtocol(conn2, false)
+	defer p2.Close()
+	p2.MaxCodeLength = 4
+	err = p1.SendPacket(&Packet{Code: "abcde", Seq: 3, Length: MaxLength})
+	assert.Nil(t, err)
+	_, err = p2.ReadPacket()
+	assert.Equal(t, ErrBuffTooLong, err.Error())
+}
+
+// benchProtocol returns a protocol writing to a peer which reads everything.
+func benchProtocol(b *testing.B) *TcpProtocol {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		p := NewTcpProtocol(peer, false)
+		for {
+			if _, err := p.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	return NewTcpProtocol(conn, false)
+}
+
+func benchmarkSendPacket(b *testing.B, length int, parallel bool) {
+	p := benchProtocol(b)
+	defer p.Close()
+	payload := make([]byte, length)
+	b.SetBytes(int64(length))
+	b.ResetTimer()
+	if !parallel {
+		for i := 0; i < b.N; i++ {
+			p.SendPacket(&Packet{Code: "bench", Seq: TSeq(i), Payload: payload})
+		}
+		return
+	}
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.SendPacket(&Packet{Code: "bench", Payload: payload})
+		}
+	})
+}
+
+func BenchmarkSendPacketSmall(b *testing.B)         { benchmarkSendPacket(b, 64, false) }
+func BenchmarkSendPacketSmallParallel(b *testing.B) { benchmarkSendPacket(b, 64, true) }
+func BenchmarkSendPacketLarge(b *testing.B)         { benchmarkSendPacket(b, 64*1024, false) }
+func BenchmarkSendPacketLargeParallel(b *testing.B) { benchmarkSendPacket(b, 64*1024, true) }
+
+// repeatReader reads the same bytes forever.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.data)
+	}
+	return n, nil
+}
+
+func benchmarkReadPacket(b *testing.B, length int) {
+	w := &bytes.Buffer{}
+	p := newTcpProtocol(nil, w, false)
+	p.SendPacket(&Packet{Code: "bench", Seq: 1, Payload: make([]byte, length)})
+	p = newTcpProtocol(&repeatReader{data: w.Bytes()}, nil, false)
+	b.SetBytes(int64(length))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt, err := p.ReadPacket()
+		if err != nil {
+			b.Fatal(err)
+		}
+		pkt.Release()
+	}
+}
+
+func BenchmarkReadPacketSmall(b *testing.B) { benchmarkReadPacket(b, 64) }
+func BenchmarkReadPacketLarge(b *testing.B) { benchmarkReadPacket(b, 64*1024) }
+
+func benchmarkWritePacket(b *testing.B, length int) {
+	p := newTcpProtocol(nil, ioutil.Discard, false)
+	pkt := &Packet{Code: "bench", Seq: 1, Payload: make([]byte, length)}
+	b.SetBytes(int64(length))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt.Length = 0
+		if err := p.SendPacket(pkt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWritePacketSmall(b *testing.B) { benchmarkWritePacket(b, 64) }
+func BenchmarkWritePacketLarge(b *testing.B) { benchmarkWritePacket(b, 64*1024) }
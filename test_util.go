@@ -18,6 +18,9 @@ func NewMockDelayProtocol(delay time.Duration) *MockProtocol {
 }
 
 func (mp *MockProtocol) SendPacket(pkt *Packet) error {
+	// the peer owns the packet it reads
+	copied := *pkt
+	pkt = &copied
 	go func() {
 		<-time.After(mp.delay)
 		mp.packetChan <- pkt
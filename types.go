@@ -0,0 +1,146 @@
+package flyrpc
+
+import (
+	"reflect"
+	"sync"
+)
+
+// types resolves the interface params of the handlers to a concrete type,
+// when the message is decoded.
+var (
+	typesLock sync.RWMutex
+	types     = map[reflect.Type]*ifaceTypes{}
+	// typeNames tags the messages of Typed
+	typeNames = map[reflect.Type]string{}
+)
+
+// ifaceTypes are the types an interface param is decoded as, they are
+// replaced on registration, not changed.
+type ifaceTypes struct {
+	// untagged messages are decoded as it, see RegisterType
+	untagged reflect.Type
+	// envelopes of the messages tagged with a name, see RegisterTypeName
+	named map[string]reflect.Type
+}
+
+// typedMessage is a message tagged with the name of its type, see Typed.
+type typedMessage struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// typeTag reads the name of a typedMessage.
+type typeTag struct {
+	Type string `json:"type"`
+}
+
+// RegisterType decodes the handler params of the interface type iface as the
+// type of value, e.g. RegisterType((*Shape)(nil), &Circle{}). An interface
+// param is registered before its route is added, the type is resolved when
+// the message is decoded. Messages tagged by Typed are decoded as the type of
+// their name, see RegisterTypeName.
+func RegisterType(iface interface{}, value interface{}) {
+	ifaceType, valueType := checkType(iface, value)
+	typesLock.Lock()
+	defer typesLock.Unlock()
+	entry := copyTypes(types[ifaceType])
+	entry.untagged = valueType
+	types[ifaceType] = entry
+}
+
+// RegisterTypeName decodes the handler params of the interface type iface as
+// the type of value when the message is tagged with name, e.g.
+// RegisterTypeName((*Shape)(nil), "circle", &Circle{}). The sender tags the
+// message with Typed, the serializer must encode structs by field names,
+// e.g. JSON, msgpack or cbor.
+func RegisterTypeName(iface interface{}, name string, value interface{}) {
+	ifaceType, valueType := checkType(iface, value)
+	if name == "" {
+		panic("name should not be empty")
+	}
+	typesLock.Lock()
+	defer typesLock.Unlock()
+	if other, ok := typeNames[valueType]; ok && other != name {
+		panic("value is registered as " + other)
+	}
+	entry := copyTypes(types[ifaceType])
+	entry.named[name] = reflect.StructOf([]reflect.StructField{{
+		Name: "Value",
+		Type: valueType,
+		Tag:  `json:"value"`,
+	}})
+	types[ifaceType] = entry
+	typeNames[valueType] = name
+}
+
+// Typed tags message with the name of its type, the peer decodes an
+// interface param as this type, see RegisterTypeName.
+func Typed(message Message) Message {
+	typesLock.RLock()
+	name, ok := typeNames[reflect.TypeOf(message)]
+	typesLock.RUnlock()
+	if !ok {
+		panic("message type must be registered, see RegisterTypeName")
+	}
+	return &typedMessage{Type: name, Value: message}
+}
+
+func checkType(iface interface{}, value interface{}) (reflect.Type, reflect.Type) {
+	ifaceType := reflect.TypeOf(iface)
+	if ifaceType == nil || ifaceType.Kind() != reflect.Ptr || ifaceType.Elem().Kind() != reflect.Interface {
+		panic("iface must be a pointer to an interface, e.g. (*Shape)(nil)")
+	}
+	ifaceType = ifaceType.Elem()
+	valueType := reflect.TypeOf(value)
+	if valueType == nil || !valueType.Implements(ifaceType) {
+		panic("value must implement iface")
+	}
+	return ifaceType, valueType
+}
+
+func copyTypes(entry *ifaceTypes) *ifaceTypes {
+	named := map[string]reflect.Type{}
+	if entry == nil {
+		return &ifaceTypes{named: named}
+	}
+	for name, t := range entry.named {
+		named[name] = t
+	}
+	return &ifaceTypes{untagged: entry.untagged, named: named}
+}
+
+func registeredTypes(iface reflect.Type) *ifaceTypes {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	return types[iface]
+}
+
+// decodeInterface decodes payload as the type named by its tag, or else as
+// the untagged type of iface.
+func decodeInterface(iface reflect.Type, payload []byte, s Serializer) (reflect.Value, error) {
+	entry := registeredTypes(iface)
+	if entry == nil {
+		return reflect.Zero(iface), newError("no type registered for " + iface.String())
+	}
+	tag := &typeTag{}
+	if len(entry.named) > 0 && s.Unmarshal(payload, tag) == nil && tag.Type != "" {
+		envelope, ok := entry.named[tag.Type]
+		if !ok {
+			return reflect.Zero(iface), newError("unknown type " + tag.Type)
+		}
+		v := reflect.New(envelope)
+		if err := s.Unmarshal(payload, v.Interface()); err != nil {
+			return reflect.Zero(iface), err
+		}
+		return v.Elem().Field(0), nil
+	}
+	if entry.untagged == nil {
+		return reflect.Zero(iface), newError("message of " + iface.String() + " must be tagged, see Typed")
+	}
+	if entry.untagged.Kind() == reflect.Ptr {
+		v := reflect.New(entry.untagged.Elem())
+		return v, s.Unmarshal(payload, v.Interface())
+	}
+	v := reflect.New(entry.untagged)
+	return v.Elem(), s.Unmarshal(payload, v.Interface())
+}
@@ -0,0 +1,94 @@
+package flyrpc
+
+import "encoding/json"
+
+// Validator is implemented by the messages checked before their handler.
+type Validator interface {
+	Validate() error
+}
+
+// ValidateFunc checks every message decoded for a handler, e.g. from its
+// struct tags. It runs before the Validate method of the message.
+type ValidateFunc func(message interface{}) error
+
+// FieldError is a field rejected by the validation.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// InvalidArgument rejects a message that fails to decode or to validate. It
+// is replied as ErrInvalidArgument with itself as payload, see
+// AsInvalidArgument. Decode and other validation errors are replied as its
+// Message.
+//
+// The payload is always JSON, whatever the serializer of the connection, so
+// that serializers of generated types only, e.g. protobuf, can carry it.
+type InvalidArgument struct {
+	Message string       `json:"message,omitempty"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func (e *InvalidArgument) Error() string {
+	return ErrInvalidArgument
+}
+
+// AsInvalidArgument returns the details of an ErrInvalidArgument reply,
+// decoded from JSON.
+func AsInvalidArgument(err error) (*InvalidArgument, bool) {
+	switch e := err.(type) {
+	case *InvalidArgument:
+		return e, true
+	case *ReplyError:
+		if e.code != ErrInvalidArgument {
+			return nil, false
+		}
+		invalid := &InvalidArgument{}
+		if e.pkt != nil && len(e.pkt.Payload) > 0 {
+			if err := json.Unmarshal(e.pkt.Payload, invalid); err != nil {
+				invalid.Message = err.Error()
+			}
+		}
+		return invalid, true
+	}
+	return nil, false
+}
+
+// SetValidator checks the messages decoded for the handlers of the Context,
+// nil for none.
+func (ctx *Context) SetValidator(validate ValidateFunc) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.validator = validate
+}
+
+// validate returns an *InvalidArgument if message is rejected.
+func (ctx *Context) validate(message interface{}) error {
+	ctx.lock.Lock()
+	validate := ctx.validator
+	ctx.lock.Unlock()
+	var err error
+	if validate != nil {
+		err = validate(message)
+	}
+	if v, ok := message.(Validator); ok && err == nil {
+		err = v.Validate()
+	}
+	if err == nil {
+		return nil
+	}
+	if invalid, ok := err.(*InvalidArgument); ok {
+		return invalid
+	}
+	return &InvalidArgument{Message: err.Error()}
+}
+
+// errorPayload returns the details of err replied to the caller, as JSON.
+func errorPayload(err error) []byte {
+	if invalid, ok := err.(*InvalidArgument); ok {
+		if payload, err := json.Marshal(invalid); err == nil {
+			return payload
+		}
+	}
+	return []byte{}
+}
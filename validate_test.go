@@ -0,0 +1,115 @@
+package flyrpc
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSignup struct {
+	Name  string `json:"name" validate:"required"`
+	Email string `json:"email" validate:"required"`
+	Age   int32  `json:"age"`
+}
+
+func (s *testSignup) Validate() error {
+	if s.Age < 0 {
+		return &InvalidArgument{Fields: []FieldError{{Field: "age", Reason: "negative"}}}
+	}
+	if s.Age > 200 {
+		return errors.New("too old")
+	}
+	return nil
+}
+
+// validateRequired checks the fields tagged validate:"required"
+func validateRequired(message interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(message))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	invalid := &InvalidArgument{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("validate") == "required" && v.Field(i).IsZero() {
+			invalid.Fields = append(invalid.Fields, FieldError{Field: field.Tag.Get("json"), Reason: "required"})
+		}
+	}
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	server := NewServer(&ServerOpts{
+		Serializer: JSON,
+		Validator:  validateRequired,
+	})
+	handled := int32(0)
+	server.OnMessage("signup", func(s *testSignup) string {
+		atomic.AddInt32(&handled, 1)
+		return "welcome " + s.Name
+	})
+	server.OnMessage("value", func(s testSignup) string {
+		atomic.AddInt32(&handled, 1)
+		return "welcome " + s.Name
+	})
+	server.OnMessage("taken", func(s *testSignup) error {
+		return &InvalidArgument{Fields: []FieldError{{Field: "name", Reason: "taken"}}}
+	})
+	go func() {
+		err := server.Listen("tcp", "127.0.0.1:15731")
+		assert.Nil(t, err)
+	}()
+	<-time.After(10 * time.Millisecond)
+	client := makeClient(t, "127.0.0.1:15731")
+
+	bytes, err := client.GetReply("signup", &testSignup{Name: "a", Email: "a@b"})
+	assert.NoError(t, err)
+	assert.Equal(t, "welcome a", string(bytes))
+
+	// the validator, then the Validate method
+	for _, code := range []string{"signup", "value"} {
+		_, err = client.GetReply(code, &testSignup{Email: "a@b", Age: -1})
+		assert.Equal(t, ErrInvalidArgument, err.Error())
+		invalid, ok := AsInvalidArgument(err)
+		assert.True(t, ok)
+		assert.Equal(t, []FieldError{{Field: "name", Reason: "required"}}, invalid.Fields)
+
+		_, err = client.GetReply(code, &testSignup{Name: "a", Email: "a@b", Age: -1})
+		invalid, ok = AsInvalidArgument(err)
+		assert.True(t, ok)
+		assert.Equal(t, []FieldError{{Field: "age", Reason: "negative"}}, invalid.Fields)
+
+		_, err = client.GetReply(code, &testSignup{Name: "a", Email: "a@b", Age: 300})
+		invalid, ok = AsInvalidArgument(err)
+		assert.True(t, ok)
+		assert.Equal(t, "too old", invalid.Message)
+		assert.Nil(t, invalid.Fields)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+
+	// returned by the handler
+	_, err = client.GetReply("taken", &testSignup{Name: "a", Email: "a@b"})
+	invalid, ok := AsInvalidArgument(err)
+	assert.True(t, ok)
+	assert.Equal(t, []FieldError{{Field: "name", Reason: "taken"}}, invalid.Fields)
+
+	_, ok = AsInvalidArgument(newReplyError(ErrNotFound, nil))
+	assert.False(t, ok)
+
+	// details are JSON with any serializer
+	assert.NoError(t, client.UseSerializer("msgpack"))
+	_, err = client.GetReply("taken", &testSignup{Name: "a", Email: "a@b"})
+	invalid, ok = AsInvalidArgument(err)
+	assert.True(t, ok)
+	assert.Equal(t, []FieldError{{Field: "name", Reason: "taken"}}, invalid.Fields)
+
+	client.Close()
+	server.Close()
+}